@@ -3,29 +3,46 @@ package main
 import (
 	"log"
 	"net/http"
-	"os"
 
+	"litterbox-agent/internal/config"
 	"litterbox-agent/internal/handler"
 	"litterbox-agent/internal/middleware"
 	"litterbox-agent/internal/service"
 )
 
 func main() {
+	// Load configuration from environment
+	cfg := config.Load()
+
 	// Initialize authentication manager
 	authManager := middleware.NewAuthManager()
 
 	// Initialize services
-	fileService := service.NewFileService()
-	execService := service.NewExecService()
+	pathPolicy, err := service.NewPathPolicy(cfg.Workspace)
+	if err != nil {
+		log.Fatalf("Invalid workspace configuration: %v", err)
+	}
+	fileService := service.NewFileService(pathPolicy)
+	execService := service.NewExecService(cfg.Exec)
 	metricsService := service.NewMetricsService()
+	jobService := service.NewJobService(execService, cfg.Job)
+	ptyService := service.NewPtyService(execService, cfg.Pty)
+	sessionService := service.NewSessionService(execService, cfg.Session)
+	uploadService, err := service.NewUploadService(fileService, cfg.Upload)
+	if err != nil {
+		log.Fatalf("Cannot create upload staging directory: %v", err)
+	}
 
 	// Initialize handlers
 	initHandler := handler.NewInitHandler(authManager)
-	uploadHandler := handler.NewUploadHandler(fileService, metricsService)
+	uploadHandler := handler.NewUploadHandler(fileService, uploadService, metricsService)
 	downloadHandler := handler.NewDownloadHandler(fileService, metricsService)
 	execHandler := handler.NewExecHandler(execService, metricsService)
 	metricsHandler := handler.NewMetricsHandler(metricsService)
 	fileHandler := handler.NewFileHandler(fileService, metricsService)
+	jobHandler := handler.NewJobHandler(jobService, metricsService)
+	ptyHandler := handler.NewPtyHandler(ptyService, metricsService)
+	sessionHandler := handler.NewSessionHandler(sessionService, metricsService)
 
 	// Register routes
 	// /init does not require authentication (but can only succeed once)
@@ -39,26 +56,47 @@ func main() {
 
 	// Protected routes (require authentication)
 	http.Handle("/upload", authManager.Protect(http.HandlerFunc(uploadHandler.Handle)))
+	http.Handle("/uploads", authManager.Protect(http.HandlerFunc(uploadHandler.HandleUploads)))
+	http.Handle("/uploads/", authManager.Protect(http.HandlerFunc(uploadHandler.HandleUpload)))
 	http.Handle("/download", authManager.Protect(http.HandlerFunc(downloadHandler.Handle)))
 	http.Handle("/exec", authManager.Protect(http.HandlerFunc(execHandler.Handle)))
+	http.Handle("/exec/stream", authManager.Protect(http.HandlerFunc(execHandler.HandleStream)))
 	http.Handle("/metrics", authManager.Protect(http.HandlerFunc(metricsHandler.Handle)))
 	http.Handle("/file", authManager.Protect(http.HandlerFunc(fileHandler.HandleOperation)))
+	http.Handle("/jobs", authManager.Protect(http.HandlerFunc(jobHandler.HandleJobs)))
+	http.Handle("/jobs/", authManager.Protect(http.HandlerFunc(jobHandler.HandleJob)))
+	http.Handle("/pty", authManager.Protect(http.HandlerFunc(ptyHandler.Handle)))
+	http.Handle("/sessions", authManager.Protect(http.HandlerFunc(sessionHandler.HandleSessions)))
+	http.Handle("/sessions/", authManager.Protect(http.HandlerFunc(sessionHandler.HandleSession)))
 
-	// Get port from environment
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	log.Printf("Agent server starting on port %s", cfg.Port)
+	log.Printf("Workspace root: %s", pathPolicy.Root())
+	if pathPolicy.Root() == "/" {
+		log.Printf("WARNING: the workspace root is /, so the file endpoints can access the whole file system except WORKSPACE_DENY; set WORKSPACE_ROOT to confine them")
 	}
-
-	log.Printf("Agent server starting on port %s", port)
 	log.Printf("Available endpoints:")
 	log.Printf("  POST   /init         - Initialize authentication (one-time only)")
 	log.Printf("  GET    /health       - Health check")
 	log.Printf("  POST   /upload       - Upload files")
-	log.Printf("  GET    /download     - Download files")
+	log.Printf("  POST   /uploads      - Create a resumable upload (tus)")
+	log.Printf("  PATCH  /uploads/{id} - Append to a resumable upload (tus)")
+	log.Printf("  PUT    /uploads/{id} - Write a chunk at any offset")
+	log.Printf("  GET    /uploads/{id} - Get received ranges of an upload")
+	log.Printf("  DELETE /uploads/{id} - Abort a resumable upload")
+	log.Printf("  GET    /download     - Download files or directories (tar.gz/zip)")
 	log.Printf("  POST   /exec         - Execute commands")
+	log.Printf("  POST   /exec/stream  - Execute commands with streamed output (SSE)")
 	log.Printf("  GET    /metrics      - View metrics")
-	log.Printf("  POST   /file         - File operations (view/create/str_replace/insert/undo_edit)")
+	log.Printf("  POST   /jobs         - Start a background job")
+	log.Printf("  GET    /jobs         - List background jobs")
+	log.Printf("  GET    /jobs/{id}    - Get job status and output")
+	log.Printf("  DELETE /jobs/{id}    - Signal a background job")
+	log.Printf("  POST   /sessions     - Create a persistent shell session")
+	log.Printf("  GET    /sessions     - List shell sessions")
+	log.Printf("  POST   /sessions/{id}/exec - Execute a command in a session")
+	log.Printf("  DELETE /sessions/{id} - Close a shell session")
+	log.Printf("  GET    /pty          - Interactive terminal (WebSocket)")
+	log.Printf("  POST   /file         - File operations (view/create/str_replace/insert/multi_edit/apply_patch/undo_edit/list/...)")
 
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	log.Fatal(http.ListenAndServe(":"+cfg.Port, nil))
 }
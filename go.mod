@@ -2,4 +2,8 @@ module litterbox-agent
 
 go 1.21
 
-require github.com/google/uuid v1.6.0 // indirect
+require (
+	github.com/creack/pty v1.1.24
+	github.com/google/uuid v1.6.0
+	github.com/gorilla/websocket v1.5.3
+)
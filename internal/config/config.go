@@ -0,0 +1,188 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds agent settings loaded from environment variables
+type Config struct {
+	Port    string
+	Exec    ExecConfig
+	Job     JobConfig
+	Pty     PtyConfig
+	Session SessionConfig
+	Upload  UploadConfig
+
+	Workspace WorkspaceConfig
+}
+
+// ExecConfig holds settings for command execution
+type ExecConfig struct {
+	DefaultTimeout time.Duration // 未指定 timeout_ms 时使用的超时
+	MaxTimeout     time.Duration // timeout_ms 允许的最大值
+	KillGrace      time.Duration // SIGTERM 与 SIGKILL 之间的等待时间
+
+	OutputHeadBytes int // 每个输出流保留的开头字节数
+	OutputTailBytes int // 每个输出流保留的结尾字节数
+
+	DefaultUser         string // 未指定 user 时运行命令的用户，为空表示与 agent 相同
+	AllowPrivilegedUser bool   // 配置了 DefaultUser 时是否允许请求以 root 用户或 root 组运行命令
+
+	DefaultCPUs        float64 // 默认 CPU 配额（核数），0 表示不限制
+	DefaultMemoryBytes int64   // 默认内存上限（字节），0 表示不限制
+	DefaultPids        int64   // 默认最大进程数，0 表示不限制
+
+	CgroupMoveAgent bool // agent 所在 cgroup 含有进程而无法启用控制器时，是否把 agent 移入子 cgroup agent
+}
+
+// JobConfig holds settings for background jobs
+type JobConfig struct {
+	OutputBufferBytes int           // 每个任务 stdout/stderr 各自保留的最大字节数
+	Retention         time.Duration // 已结束任务的保留时间
+}
+
+// PtyConfig holds settings for interactive terminal sessions
+type PtyConfig struct {
+	Shell          string   // 登录 shell，为空时依次尝试 /bin/bash、/bin/sh
+	AllowedOrigins []string // 除同源请求外允许建立 WebSocket 连接的 Origin，"*" 表示不限制
+}
+
+// SessionConfig holds settings for persistent shell sessions
+type SessionConfig struct {
+	IdleTimeout time.Duration // 空闲超过该时间的会话会被自动关闭
+}
+
+// UploadConfig holds settings for resumable uploads
+type UploadConfig struct {
+	StagingDir string        // 未完成上传及 multipart 文件部分的数据暂存目录
+	SessionTTL time.Duration // 超过该时间没有新数据的上传会话会被清理
+	MaxSize    int64         // 单个文件的最大字节数，0 表示不限制
+
+	ExtractMaxBytes   int64 // 解压一个压缩包得到的文件总字节数上限，0 表示不限制
+	ExtractMaxEntries int   // 一个压缩包的最大条目数，0 表示不限制
+}
+
+// WorkspaceConfig holds the path policy applied to the file endpoints
+type WorkspaceConfig struct {
+	Root  string   // 文件接口可以访问的根目录，相对路径也基于该目录解析
+	Allow []string // 工作区之外额外允许访问的目录
+	Deny  []string // 禁止访问的路径，优先于 Root 和 Allow
+}
+
+// Load reads the configuration from the environment, falling back to defaults
+func Load() *Config {
+	return &Config{
+		Port: getEnv("PORT", "8080"),
+		Exec: ExecConfig{
+			DefaultTimeout: getEnvMillis("EXEC_DEFAULT_TIMEOUT_MS", 5*time.Minute),
+			MaxTimeout:     getEnvMillis("EXEC_MAX_TIMEOUT_MS", time.Hour),
+			KillGrace:      getEnvMillis("EXEC_KILL_GRACE_MS", 5*time.Second),
+
+			OutputHeadBytes: int(getEnvInt64("EXEC_OUTPUT_HEAD_BYTES", 512<<10)),
+			OutputTailBytes: int(getEnvInt64("EXEC_OUTPUT_TAIL_BYTES", 512<<10)),
+
+			DefaultUser:         os.Getenv("EXEC_DEFAULT_USER"),
+			AllowPrivilegedUser: getEnvBool("EXEC_ALLOW_PRIVILEGED_USER", false),
+
+			DefaultCPUs:        getEnvFloat("EXEC_DEFAULT_CPUS", 0),
+			DefaultMemoryBytes: getEnvInt64("EXEC_DEFAULT_MEMORY_BYTES", 0),
+			DefaultPids:        getEnvInt64("EXEC_DEFAULT_PIDS", 0),
+
+			CgroupMoveAgent: getEnvBool("EXEC_CGROUP_MOVE_AGENT", false),
+		},
+		Job: JobConfig{
+			OutputBufferBytes: int(getEnvInt64("JOB_OUTPUT_BUFFER_BYTES", 1<<20)),
+			Retention:         getEnvMillis("JOB_RETENTION_MS", time.Hour),
+		},
+		Pty: PtyConfig{
+			Shell:          os.Getenv("PTY_SHELL"),
+			AllowedOrigins: getEnvCommaList("PTY_ALLOWED_ORIGINS"),
+		},
+		Session: SessionConfig{
+			IdleTimeout: getEnvMillis("SESSION_IDLE_TIMEOUT_MS", 30*time.Minute),
+		},
+		Upload: UploadConfig{
+			StagingDir: getEnv("UPLOAD_STAGING_DIR", filepath.Join(os.TempDir(), "litterbox-uploads")),
+			SessionTTL: getEnvMillis("UPLOAD_SESSION_TTL_MS", 24*time.Hour),
+			MaxSize:    getEnvInt64("UPLOAD_MAX_BYTES", 0),
+
+			ExtractMaxBytes:   getEnvInt64("UPLOAD_EXTRACT_MAX_BYTES", 8<<30),
+			ExtractMaxEntries: int(getEnvInt64("UPLOAD_EXTRACT_MAX_ENTRIES", 100000)),
+		},
+		Workspace: WorkspaceConfig{
+			Root:  getEnv("WORKSPACE_ROOT", "/"),
+			Allow: getEnvList("WORKSPACE_ALLOW"),
+			Deny:  getEnvList("WORKSPACE_DENY"),
+		},
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvList splits a variable like PATH, dropping empty entries
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range filepath.SplitList(os.Getenv(key)) {
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvCommaList splits a comma-separated variable, for values like URLs
+// that contain colons, dropping empty entries
+func getEnvCommaList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getEnvInt64(key string, fallback int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fallback
+	}
+	return f
+}
+
+func getEnvMillis(key string, fallback time.Duration) time.Duration {
+	return time.Duration(getEnvInt64(key, int64(fallback/time.Millisecond))) * time.Millisecond
+}
@@ -1,6 +1,10 @@
 package handler
 
 import (
+	"errors"
+	"io"
+	"log"
+	"mime"
 	"net/http"
 	"path/filepath"
 
@@ -8,6 +12,9 @@ import (
 	"litterbox-agent/internal/utils"
 )
 
+// maxETagFileSize is the size up to which downloads always carry an ETag
+const maxETagFileSize = 64 << 20
+
 type DownloadHandler struct {
 	fileService    *service.FileService
 	metricsService *service.MetricsService
@@ -28,22 +35,86 @@ func (h *DownloadHandler) Handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filePath := r.URL.Query().Get("path")
+	query := r.URL.Query()
+	filePath := query.Get("path")
 	if filePath == "" {
 		utils.WriteError(w, http.StatusBadRequest, "File path required")
 		return
 	}
 
+	// 指定 format 时打包下载，目录默认打包为 tar.gz
+	if format := query.Get("format"); format != "" {
+		h.streamArchive(w, filePath, format, query["include"], query["exclude"])
+		return
+	}
+
 	file, stat, err := h.fileService.DownloadFile(filePath)
 	if err != nil {
+		var serviceErr *service.Error
+		if errors.As(err, &serviceErr) {
+			writeServiceError(w, err)
+			return
+		}
 		utils.WriteError(w, http.StatusNotFound, err.Error())
 		return
 	}
 	defer file.Close()
 
-	w.Header().Set("Content-Disposition", "attachment; filename="+filepath.Base(filePath))
+	if stat.IsDir() {
+		h.streamArchive(w, filePath, service.ArchiveTarGz, query["include"], query["exclude"])
+		return
+	}
+
+	// 内容哈希作为 ETag，与 view 返回的 etag 相同，ServeContent 据此处理
+	// If-Match 和 If-None-Match。大文件只在请求带条件头时计算
+	if stat.Size() <= maxETagFileSize || r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" {
+		etag, err := service.ETag(file)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("ETag", `"`+etag+`"`)
+	}
+
+	w.Header().Set("Content-Disposition", attachment(filepath.Base(file.Name())))
 	w.Header().Set("Content-Type", "application/octet-stream")
 	http.ServeContent(w, r, stat.Name(), stat.ModTime(), file)
 
 	h.metricsService.IncrementDownload()
 }
+
+// streamArchive sends a directory as an archive created on the fly
+func (h *DownloadHandler) streamArchive(w http.ResponseWriter, path, format string, include, exclude []string) {
+	headerWritten := false
+	started := func(filename string) {
+		contentType := "application/gzip"
+		if format == service.ArchiveZip {
+			contentType = "application/zip"
+		}
+		w.Header().Set("Content-Disposition", attachment(filename))
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		headerWritten = true
+	}
+
+	if err := h.fileService.StreamArchive(path, format, include, exclude, started, w); err != nil {
+		if !headerWritten {
+			writeServiceError(w, err)
+			return
+		}
+		// 响应已经开始，只能中断连接，让客户端知道归档不完整
+		log.Printf("Archive download of %s failed: %v", path, err)
+		panic(http.ErrAbortHandler)
+	}
+
+	h.metricsService.IncrementDownload()
+}
+
+// attachment builds a Content-Disposition header value for filename,
+// encoding it as needed for spaces, quotes and non-ASCII characters
+func attachment(filename string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
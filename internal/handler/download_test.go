@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"litterbox-agent/internal/config"
+	"litterbox-agent/internal/service"
+)
+
+// newTestFileService creates a file service whose workspace is a temporary
+// directory
+func newTestFileService(t *testing.T) (*service.FileService, string) {
+	t.Helper()
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := service.NewPathPolicy(config.WorkspaceConfig{Root: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service.NewFileService(policy), dir
+}
+
+func download(h *DownloadHandler, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/download?path="+url.QueryEscape(path), nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rec := httptest.NewRecorder()
+	h.Handle(rec, req)
+	return rec
+}
+
+func TestDownloadConditional(t *testing.T) {
+	fileService, dir := newTestFileService(t)
+	h := NewDownloadHandler(fileService, service.NewMetricsService())
+	path := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := download(h, path, nil)
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" || rec.Body.String() != "content" {
+		t.Fatalf("status %d, etag %q, body %q; want the file with an ETag", rec.Code, etag, rec.Body)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"If-None-Match current", http.Header{"If-None-Match": {etag}}, http.StatusNotModified},
+		{"If-None-Match stale", http.Header{"If-None-Match": {`"stale"`}}, http.StatusOK},
+		{"If-Match current", http.Header{"If-Match": {etag}}, http.StatusOK},
+		{"If-Match stale", http.Header{"If-Match": {`"stale"`}}, http.StatusPreconditionFailed},
+	} {
+		if rec := download(h, path, tt.header); rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestDownloadLargeFileETagOnlyWhenConditional(t *testing.T) {
+	fileService, dir := newTestFileService(t)
+	h := NewDownloadHandler(fileService, service.NewMetricsService())
+	path := filepath.Join(dir, "large.bin")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 稀疏文件，不占用磁盘空间
+	if err := file.Truncate(maxETagFileSize + 1); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	rec := download(h, path, nil)
+	if etag := rec.Header().Get("ETag"); etag != "" {
+		t.Errorf("ETag %q computed for a large file without a conditional header", etag)
+	}
+
+	rec = download(h, path, http.Header{"If-None-Match": {`"stale"`}})
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("status %d, etag %q; want the ETag computed for a conditional request", rec.Code, etag)
+	}
+	if rec := download(h, path, http.Header{"If-None-Match": {etag}}); rec.Code != http.StatusNotModified {
+		t.Errorf("status %d for a matching If-None-Match, want 304", rec.Code)
+	}
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"litterbox-agent/internal/service"
+	"litterbox-agent/internal/utils"
+)
+
+// errorStatus maps service error codes to HTTP status codes
+var errorStatus = map[string]int{
+	service.CodeInvalidRequest: http.StatusBadRequest,
+	service.CodeInvalidCwd:     http.StatusBadRequest,
+
+	service.CodePermissionDenied: http.StatusForbidden,
+	service.CodeUserNotFound:     http.StatusBadRequest,
+	service.CodeGroupNotFound:    http.StatusBadRequest,
+
+	service.CodeExecutableNotFound: http.StatusBadRequest,
+
+	service.CodePathOutsideWorkspace: http.StatusForbidden,
+	service.CodePathNotAllowed:       http.StatusForbidden,
+
+	service.CodeNotFound:      http.StatusNotFound,
+	service.CodeAlreadyExists: http.StatusConflict,
+	service.CodeNotEmpty:      http.StatusConflict,
+	service.CodeNotDirectory:  http.StatusBadRequest,
+	service.CodeIsDirectory:   http.StatusBadRequest,
+
+	service.CodeInvalidArchive: http.StatusBadRequest,
+
+	service.CodeConflict: http.StatusConflict,
+
+	service.CodeOffsetMismatch:   http.StatusConflict,
+	service.CodeChecksumMismatch: http.StatusUnprocessableEntity,
+	service.CodeTooLarge:         http.StatusRequestEntityTooLarge,
+}
+
+// errorStatusOf returns the HTTP status code for err
+func errorStatusOf(err error) int {
+	var serviceErr *service.Error
+	if errors.As(err, &serviceErr) {
+		if status, ok := errorStatus[serviceErr.Code]; ok {
+			return status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// writeServiceError writes err as a JSON error response, using the status and
+// code of a *service.Error when available
+func writeServiceError(w http.ResponseWriter, err error) {
+	var serviceErr *service.Error
+	if errors.As(err, &serviceErr) {
+		utils.WriteErrorCode(w, errorStatusOf(err), serviceErr.Code, serviceErr.Message)
+		return
+	}
+
+	utils.WriteError(w, http.StatusInternalServerError, err.Error())
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"litterbox-agent/internal/model"
@@ -29,19 +30,90 @@ func (h *ExecHandler) Handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req model.CommandRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		utils.WriteError(w, http.StatusBadRequest, err.Error())
+	req, ok := decodeCommandRequest(w, r)
+	if !ok {
 		return
 	}
 
-	if req.Command == "" {
-		utils.WriteError(w, http.StatusBadRequest, "Command required")
+	response, err := h.execService.ExecuteCommand(r.Context(), req)
+	if err != nil {
+		writeServiceError(w, err)
 		return
 	}
-
-	response := h.execService.ExecuteCommand(req.Command)
 	h.metricsService.IncrementCommand()
 
 	utils.WriteSuccess(w, response)
 }
+
+// HandleStream executes a command and streams its output as Server-Sent Events
+func (h *ExecHandler) HandleStream(w http.ResponseWriter, r *http.Request) {
+	h.metricsService.IncrementRequest()
+
+	if r.Method != http.MethodPost {
+		utils.WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		utils.WriteError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	req, ok := decodeCommandRequest(w, r)
+	if !ok {
+		return
+	}
+
+	started := func() {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+	}
+	emit := func(event *model.ExecStreamEvent) {
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data)
+		flusher.Flush()
+	}
+
+	if err := h.execService.StreamCommand(r.Context(), req, started, emit); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	h.metricsService.IncrementCommand()
+}
+
+// decodeCommandRequest parses and validates a command request, writing an
+// error response and returning false if it is invalid
+func decodeCommandRequest(w http.ResponseWriter, r *http.Request) (*model.CommandRequest, bool) {
+	var req model.CommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+
+	if req.Command == "" && len(req.Argv) == 0 {
+		utils.WriteError(w, http.StatusBadRequest, "Command or argv required")
+		return nil, false
+	}
+
+	if req.Command != "" && len(req.Argv) > 0 {
+		utils.WriteError(w, http.StatusBadRequest, "Only one of command and argv may be set")
+		return nil, false
+	}
+
+	if len(req.Argv) > 0 && req.Argv[0] == "" {
+		utils.WriteError(w, http.StatusBadRequest, "argv[0] must not be empty")
+		return nil, false
+	}
+
+	if req.TimeoutMs < 0 {
+		utils.WriteError(w, http.StatusBadRequest, "timeout_ms must not be negative")
+		return nil, false
+	}
+
+	return &req, true
+}
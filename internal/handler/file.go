@@ -52,9 +52,18 @@ func (h *FileHandler) HandleOperation(w http.ResponseWriter, r *http.Request) {
 			utils.WriteError(w, http.StatusBadRequest, "file_text required for create command")
 			return
 		}
-	case "str_replace":
-		if req.OldStr == "" {
-			utils.WriteError(w, http.StatusBadRequest, "old_str required for str_replace command")
+	case "multi_edit":
+		if len(req.Edits) == 0 {
+			utils.WriteError(w, http.StatusBadRequest, "edits required for multi_edit command")
+			return
+		}
+	case "apply_patch":
+		if req.Patch == "" {
+			utils.WriteError(w, http.StatusBadRequest, "patch required for apply_patch command")
+			return
+		}
+		if req.Fuzz != nil && *req.Fuzz < 0 {
+			utils.WriteError(w, http.StatusBadRequest, "fuzz must not be negative")
 			return
 		}
 	case "insert":
@@ -62,11 +71,26 @@ func (h *FileHandler) HandleOperation(w http.ResponseWriter, r *http.Request) {
 			utils.WriteError(w, http.StatusBadRequest, "new_str required for insert command")
 			return
 		}
+	case "move", "copy":
+		if req.Destination == "" {
+			utils.WriteError(w, http.StatusBadRequest, "destination required for "+req.Command+" command")
+			return
+		}
+	case "search":
+		if req.Pattern == "" {
+			utils.WriteError(w, http.StatusBadRequest, "pattern required for search command")
+			return
+		}
+	case "chmod":
+		if req.Mode == "" {
+			utils.WriteError(w, http.StatusBadRequest, "mode required for chmod command")
+			return
+		}
 	}
 
 	response, err := h.fileService.FileOperation(&req)
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		writeServiceError(w, err)
 		return
 	}
 
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"litterbox-agent/internal/model"
+	"litterbox-agent/internal/service"
+)
+
+func postFileOperation(t *testing.T, h *FileHandler, req *model.FileOperationRequest) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h.HandleOperation(rec, httptest.NewRequest(http.MethodPost, "/file", bytes.NewReader(body)))
+	return rec
+}
+
+func TestFileOperationIfMatchConflict(t *testing.T) {
+	fileService, dir := newTestFileService(t)
+	h := NewFileHandler(fileService, service.NewMetricsService())
+	path := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(path, []byte("one\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []*model.FileOperationRequest{
+		{Command: "str_replace", Path: path, OldStr: "one", NewStr: "uno", IfMatch: "stale"},
+		{Command: "create", Path: path, FileText: "replaced\n", IfMatch: "stale"},
+		// 文件不存在时 if_match 同样不成立
+		{Command: "create", Path: filepath.Join(dir, "missing.txt"), FileText: "new\n", IfMatch: "stale"},
+	} {
+		rec := postFileOperation(t, h, req)
+		if rec.Code != http.StatusConflict {
+			t.Errorf("%s %s: status %d, want 409: %s", req.Command, filepath.Base(req.Path), rec.Code, rec.Body)
+		}
+	}
+	if data, _ := os.ReadFile(path); string(data) != "one\n" {
+		t.Errorf("file = %q, want it untouched", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.txt")); !os.IsNotExist(err) {
+		t.Errorf("missing.txt was created: %v", err)
+	}
+}
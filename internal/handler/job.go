@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"litterbox-agent/internal/service"
+	"litterbox-agent/internal/utils"
+)
+
+type JobHandler struct {
+	jobService     *service.JobService
+	metricsService *service.MetricsService
+}
+
+func NewJobHandler(jobService *service.JobService, metricsService *service.MetricsService) *JobHandler {
+	return &JobHandler{
+		jobService:     jobService,
+		metricsService: metricsService,
+	}
+}
+
+// HandleJobs handles /jobs: POST starts a job, GET lists jobs
+func (h *JobHandler) HandleJobs(w http.ResponseWriter, r *http.Request) {
+	h.metricsService.IncrementRequest()
+
+	switch r.Method {
+	case http.MethodPost:
+		req, ok := decodeCommandRequest(w, r)
+		if !ok {
+			return
+		}
+
+		job, err := h.jobService.StartJob(req)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		h.metricsService.IncrementCommand()
+
+		utils.WriteJSON(w, http.StatusAccepted, job)
+	case http.MethodGet:
+		utils.WriteSuccess(w, h.jobService.ListJobs())
+	default:
+		utils.WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// HandleJob handles /jobs/{id}: GET returns status and output, DELETE signals the job
+func (h *JobHandler) HandleJob(w http.ResponseWriter, r *http.Request) {
+	h.metricsService.IncrementRequest()
+
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	if id == "" || strings.Contains(id, "/") {
+		utils.WriteErrorCode(w, http.StatusNotFound, service.CodeNotFound, "job not found")
+		return
+	}
+
+	var (
+		job interface{}
+		err error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		job, err = h.jobService.GetJob(id)
+	case http.MethodDelete:
+		job, err = h.jobService.KillJob(id, r.URL.Query().Get("signal"))
+	default:
+		utils.WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	utils.WriteSuccess(w, job)
+}
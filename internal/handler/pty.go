@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"litterbox-agent/internal/model"
+	"litterbox-agent/internal/service"
+	"litterbox-agent/internal/utils"
+)
+
+const (
+	defaultPtyRows = 24
+	defaultPtyCols = 80
+
+	ptyDrainTimeout = time.Second
+)
+
+type PtyHandler struct {
+	ptyService     *service.PtyService
+	metricsService *service.MetricsService
+	upgrader       websocket.Upgrader
+}
+
+func NewPtyHandler(ptyService *service.PtyService, metricsService *service.MetricsService) *PtyHandler {
+	h := &PtyHandler{
+		ptyService:     ptyService,
+		metricsService: metricsService,
+	}
+	h.upgrader = websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		CheckOrigin:     h.checkOrigin,
+	}
+	return h
+}
+
+// checkOrigin accepts connections without an Origin header, which do not
+// come from a browser, same-origin connections and those from the configured
+// origins. A proxy in front of the agent may add the token for browsers, so
+// the token alone does not stop other sites from opening a terminal.
+func (h *PtyHandler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return h.ptyService.OriginAllowed(origin)
+}
+
+// Handle upgrades the connection to a WebSocket and attaches it to a new
+// pseudo-terminal. Binary frames from the client are written to the terminal
+// as-is; text frames carry JSON control messages (input or resize). Terminal
+// output is sent back as binary frames, followed by an exit message.
+func (h *PtyHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	h.metricsService.IncrementRequest()
+
+	if r.Method != http.MethodGet {
+		utils.WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	rows := parseWindowSize(r.URL.Query().Get("rows"), defaultPtyRows)
+	cols := parseWindowSize(r.URL.Query().Get("cols"), defaultPtyCols)
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade 已经写入了错误响应
+		return
+	}
+	defer conn.Close()
+
+	session, err := h.ptyService.StartSession(rows, cols, r.URL.Query().Get("user"))
+	if err != nil {
+		conn.WriteJSON(model.PtyMessage{Type: "error", Data: err.Error()})
+		return
+	}
+	defer session.Close()
+	h.metricsService.IncrementCommand()
+
+	// gorilla/websocket 不支持并发写
+	var writeMu sync.Mutex
+	writeMessage := func(msgType int, data []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteMessage(msgType, data)
+	}
+
+	// 终端输出 -> WebSocket
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := session.Read(buf)
+			if n > 0 {
+				if err := writeMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// WebSocket -> 终端输入
+	inputDone := make(chan struct{})
+	go func() {
+		defer close(inputDone)
+		for {
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			if msgType == websocket.BinaryMessage {
+				if _, err := session.Write(data); err != nil {
+					return
+				}
+				continue
+			}
+
+			var msg model.PtyMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				continue
+			}
+			switch msg.Type {
+			case "input":
+				if _, err := session.Write([]byte(msg.Data)); err != nil {
+					return
+				}
+			case "resize":
+				if msg.Rows > 0 && msg.Cols > 0 {
+					if err := session.Resize(msg.Rows, msg.Cols); err != nil {
+						log.Printf("pty resize failed: %v", err)
+					}
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-session.Done():
+		// shell 已退出，等待剩余输出发送完毕后通知客户端。
+		// 后台子进程可能仍持有终端，因此最多等待 ptyDrainTimeout
+		select {
+		case <-outputDone:
+		case <-time.After(ptyDrainTimeout):
+		}
+		exitCode := session.ExitCode()
+		data, _ := json.Marshal(model.PtyMessage{Type: "exit", ExitCode: &exitCode})
+		writeMessage(websocket.TextMessage, data)
+		writeMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	case <-inputDone:
+		// 客户端断开连接，由 session.Close 终止 shell
+	}
+}
+
+func parseWindowSize(value string, fallback uint16) uint16 {
+	n, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || n == 0 {
+		return fallback
+	}
+	return uint16(n)
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"litterbox-agent/internal/config"
+	"litterbox-agent/internal/model"
+	"litterbox-agent/internal/service"
+)
+
+func newTestPtyServer(t *testing.T, allowedOrigins ...string) *httptest.Server {
+	t.Helper()
+
+	execService := service.NewExecService(config.ExecConfig{KillGrace: time.Second})
+	ptyService := service.NewPtyService(execService, config.PtyConfig{Shell: "/bin/sh", AllowedOrigins: allowedOrigins})
+	h := NewPtyHandler(ptyService, service.NewMetricsService())
+	server := httptest.NewServer(http.HandlerFunc(h.Handle))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func dialPty(server *httptest.Server, query string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/pty?" + query
+	return websocket.DefaultDialer.Dial(url, header)
+}
+
+// readPty collects terminal output until the exit message arrives, or until
+// done returns true for the output received so far
+func readPty(t *testing.T, conn *websocket.Conn, done func(output string) bool) (string, *model.PtyMessage) {
+	t.Helper()
+
+	var output strings.Builder
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading from the terminal: %v; output so far %q", err, output.String())
+		}
+		if msgType == websocket.BinaryMessage {
+			output.Write(data)
+			if done != nil && done(output.String()) {
+				return output.String(), nil
+			}
+			continue
+		}
+
+		var msg model.PtyMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == "exit" || msg.Type == "error" {
+			return output.String(), &msg
+		}
+	}
+}
+
+func TestPtyOrigin(t *testing.T) {
+	server := newTestPtyServer(t, "https://ide.example")
+
+	for _, tt := range []struct {
+		origin string
+		allow  bool
+	}{
+		{"", true},
+		{server.URL, true},
+		{"https://ide.example", true},
+		{"https://evil.example", false},
+	} {
+		header := http.Header{}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		conn, resp, err := dialPty(server, "", header)
+		switch {
+		case tt.allow && err != nil:
+			t.Errorf("origin %q: %v, want the connection accepted", tt.origin, err)
+		case !tt.allow && (err == nil || resp == nil || resp.StatusCode != http.StatusForbidden):
+			t.Errorf("origin %q: %v, want 403", tt.origin, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestPtyResizeAndExitCode(t *testing.T) {
+	server := newTestPtyServer(t)
+	conn, _, err := dialPty(server, "rows=24&cols=80", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(model.PtyMessage{Type: "resize", Rows: 40, Cols: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(model.PtyMessage{Type: "input", Data: "stty size; exit 3\n"}); err != nil {
+		t.Fatal(err)
+	}
+
+	output, msg := readPty(t, conn, nil)
+	if msg.Type != "exit" || msg.ExitCode == nil || *msg.ExitCode != 3 {
+		t.Errorf("final message %+v, want exit with code 3", msg)
+	}
+	if !strings.Contains(output, "40 100") {
+		t.Errorf("output %q, want the resized window size", output)
+	}
+}
+
+func TestPtyCloseKillsShell(t *testing.T) {
+	server := newTestPtyServer(t)
+	conn, _, err := dialPty(server, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("echo PID=$$; sleep 100\n")); err != nil {
+		t.Fatal(err)
+	}
+	pidPattern := regexp.MustCompile(`PID=(\d+)`)
+	output, _ := readPty(t, conn, func(output string) bool { return pidPattern.MatchString(output) })
+	pid, _ := strconv.Atoi(pidPattern.FindStringSubmatch(output)[1])
+	conn.Close()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("shell %d still running after the connection was closed", pid)
+		}
+	}
+}
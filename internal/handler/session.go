@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"litterbox-agent/internal/model"
+	"litterbox-agent/internal/service"
+	"litterbox-agent/internal/utils"
+)
+
+type SessionHandler struct {
+	sessionService *service.SessionService
+	metricsService *service.MetricsService
+}
+
+func NewSessionHandler(sessionService *service.SessionService, metricsService *service.MetricsService) *SessionHandler {
+	return &SessionHandler{
+		sessionService: sessionService,
+		metricsService: metricsService,
+	}
+}
+
+// HandleSessions handles /sessions: POST creates a session, GET lists sessions
+func (h *SessionHandler) HandleSessions(w http.ResponseWriter, r *http.Request) {
+	h.metricsService.IncrementRequest()
+
+	switch r.Method {
+	case http.MethodPost:
+		var req model.SessionRequest
+		// 请求体可以为空
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			utils.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		session, err := h.sessionService.CreateSession(&req)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusCreated, session)
+	case http.MethodGet:
+		utils.WriteSuccess(w, h.sessionService.ListSessions())
+	default:
+		utils.WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// HandleSession handles /sessions/{id} (GET, DELETE) and /sessions/{id}/exec (POST)
+func (h *SessionHandler) HandleSession(w http.ResponseWriter, r *http.Request) {
+	h.metricsService.IncrementRequest()
+
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+	if id == "" {
+		utils.WriteErrorCode(w, http.StatusNotFound, service.CodeNotFound, "session not found")
+		return
+	}
+
+	switch {
+	case action == "exec" && r.Method == http.MethodPost:
+		h.exec(w, r, id)
+	case action == "" && r.Method == http.MethodGet:
+		session, err := h.sessionService.GetSession(id)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		utils.WriteSuccess(w, session)
+	case action == "" && r.Method == http.MethodDelete:
+		if err := h.sessionService.CloseSession(id); err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		utils.WriteSuccess(w, map[string]string{
+			"status": "closed",
+			"id":     id,
+		})
+	case action == "" || action == "exec":
+		utils.WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	default:
+		utils.WriteError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (h *SessionHandler) exec(w http.ResponseWriter, r *http.Request, id string) {
+	req, ok := decodeCommandRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if len(req.Argv) > 0 {
+		utils.WriteError(w, http.StatusBadRequest, "argv is not supported in session exec; use command")
+		return
+	}
+
+	if req.Limits != nil {
+		utils.WriteError(w, http.StatusBadRequest, "limits are not supported in session exec")
+		return
+	}
+
+	// 会话的工作目录和环境变量是持久的，只能在创建会话时指定
+	if req.Cwd != "" || len(req.Env) > 0 || req.ReplaceEnv || req.Stdin != "" || req.User != "" || req.Group != "" {
+		utils.WriteError(w, http.StatusBadRequest, "cwd, env, stdin, user and group are not supported in session exec; set them when creating the session")
+		return
+	}
+
+	response, err := h.sessionService.Exec(r.Context(), id, req)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	h.metricsService.IncrementCommand()
+
+	utils.WriteSuccess(w, response)
+}
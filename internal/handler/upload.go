@@ -1,24 +1,48 @@
 package handler
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 
+	"litterbox-agent/internal/model"
 	"litterbox-agent/internal/service"
 	"litterbox-agent/internal/utils"
 )
 
+// tusVersion is the version of the tus resumable upload protocol spoken by
+// /uploads, see https://tus.io/protocols/resumable-upload
+const tusVersion = "1.0.0"
+
+// tusContentType is the content type of tus PATCH requests
+const tusContentType = "application/offset+octet-stream"
+
 type UploadHandler struct {
 	fileService    *service.FileService
+	uploadService  *service.UploadService
 	metricsService *service.MetricsService
 }
 
-func NewUploadHandler(fileService *service.FileService, metricsService *service.MetricsService) *UploadHandler {
+func NewUploadHandler(fileService *service.FileService, uploadService *service.UploadService, metricsService *service.MetricsService) *UploadHandler {
 	return &UploadHandler{
 		fileService:    fileService,
+		uploadService:  uploadService,
 		metricsService: metricsService,
 	}
 }
 
+// Handle handles /upload. The multipart body is streamed: file parts are
+// spooled to the staging directory as they arrive, so the form fields may
+// come before or after them, and once the whole body has been read every
+// file is moved, or extracted, to its destination.
 func (h *UploadHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	h.metricsService.IncrementRequest()
 
@@ -27,28 +51,362 @@ func (h *UploadHandler) Handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
+	reader, err := r.MultipartReader()
+	if err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	file, header, err := r.FormFile("file")
+	var (
+		uploadDir string
+		extract   bool
+		format    string
+		files     = []*model.UploadedFile{}
+		staged    []stagedPart // 与 files 一一对应
+		errs      []error
+		extracted *model.ExtractResponse
+	)
+	defer func() {
+		for _, part := range staged {
+			h.uploadService.DiscardStaged(part.file)
+		}
+	}()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		name := partFileName(part)
+		if name == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFormValueBytes))
+			part.Close()
+			if err != nil {
+				utils.WriteError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			switch part.FormName() {
+			case "path":
+				uploadDir = string(value)
+			case "extract":
+				extract, _ = strconv.ParseBool(string(value))
+			case "format":
+				format = string(value)
+			}
+			continue
+		}
+
+		file := &model.UploadedFile{Name: name}
+		stagedFile, size, err := h.uploadService.StageFile(part)
+		part.Close()
+		if err != nil {
+			// 超出大小限制时返回 413；暂存文件写入失败是服务端错误，其他错误来自读取请求体
+			var serviceErr *service.Error
+			var pathErr *os.PathError
+			if errors.As(err, &serviceErr) {
+				writeServiceError(w, err)
+			} else if errors.As(err, &pathErr) {
+				utils.WriteError(w, http.StatusInternalServerError, err.Error())
+			} else {
+				utils.WriteError(w, http.StatusBadRequest, err.Error())
+			}
+			return
+		}
+		staged = append(staged, stagedPart{file: stagedFile, size: size})
+		files = append(files, file)
+	}
+
+	for i, file := range files {
+		part := staged[i]
+
+		var err error
+		if extract {
+			extracted, err = h.uploadService.ExtractArchive(part.file, part.size, file.Name, uploadDir, format)
+			if err == nil {
+				file.Path = extracted.Path
+				file.Size = extracted.Bytes
+				file.Format = extracted.Format
+				file.Files = extracted.Files
+			}
+		} else {
+			file.Path, file.Size, err = h.uploadService.PlaceFile(part.file, file.Name, uploadDir)
+		}
+
+		if err != nil {
+			file.Error = err.Error()
+			var serviceErr *service.Error
+			if errors.As(err, &serviceErr) {
+				file.Code = serviceErr.Code
+			}
+			errs = append(errs, err)
+		} else {
+			h.metricsService.IncrementUpload()
+		}
+	}
+
+	switch {
+	case len(files) == 0:
+		utils.WriteError(w, http.StatusBadRequest, "no file parts in request")
+		return
+	case len(files) == 1 && len(errs) == 1:
+		// 只上传一个文件时保持原有的响应格式
+		writeServiceError(w, errs[0])
+		return
+	case len(files) == 1 && extract:
+		utils.WriteSuccess(w, extracted)
+		return
+	}
+
+	response := &model.UploadResponse{Status: "success", Files: files}
+	for _, file := range files {
+		response.Bytes += file.Size
+	}
+	if len(files) == 1 {
+		response.Path = files[0].Path
+	}
+
+	switch {
+	case len(errs) == len(files):
+		response.Status = "failed"
+		utils.WriteJSON(w, errorStatusOf(errs[0]), response)
+	case len(errs) > 0:
+		response.Status = "partial"
+		utils.WriteSuccess(w, response)
+	default:
+		utils.WriteSuccess(w, response)
+	}
+}
+
+// stagedPart is a file part of an upload spooled to the staging directory
+type stagedPart struct {
+	file *os.File
+	size int64
+}
+
+// maxFormValueBytes limits the size of the non-file fields of an upload
+const maxFormValueBytes = 64 << 10
+
+// partFileName returns the file name of a multipart part including any
+// directories, which Part.FileName strips
+func partFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
 	if err != nil {
-		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return ""
+	}
+	return params["filename"]
+}
+
+// HandleUploads handles /uploads: POST creates a resumable upload, OPTIONS
+// reports the supported tus extensions
+func (h *UploadHandler) HandleUploads(w http.ResponseWriter, r *http.Request) {
+	h.metricsService.IncrementRequest()
+
+	if !h.checkTusVersion(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,creation-with-upload,termination,expiration")
+		if maxSize := h.uploadService.MaxSize(); maxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		h.create(w, r)
+	default:
+		utils.WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// HandleUpload handles /uploads/{id}: HEAD and GET report the progress,
+// PATCH appends data (tus), PUT writes data at any offset and DELETE aborts
+// the upload
+func (h *UploadHandler) HandleUpload(w http.ResponseWriter, r *http.Request) {
+	h.metricsService.IncrementRequest()
+
+	if !h.checkTusVersion(w, r) {
 		return
 	}
-	defer file.Close()
 
-	uploadDir := r.FormValue("path")
-	dst, err := h.fileService.UploadFile(file, header, uploadDir)
+	id := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	if id == "" || strings.Contains(id, "/") {
+		utils.WriteError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		info, err := h.uploadService.GetUpload(id)
+		if err != nil {
+			// HEAD 响应没有响应体，只返回状态码
+			w.WriteHeader(errorStatusOf(err))
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Length", strconv.FormatInt(info.Size, 10))
+		writeUploadHeaders(w, info)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		info, err := h.uploadService.GetUpload(id)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		utils.WriteSuccess(w, info)
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != tusContentType {
+			utils.WriteError(w, http.StatusUnsupportedMediaType, "Content-Type must be "+tusContentType)
+			return
+		}
+		info, ok := h.write(w, r, id, true)
+		if !ok {
+			return
+		}
+		writeUploadHeaders(w, info)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPut:
+		info, ok := h.write(w, r, id, false)
+		if !ok {
+			return
+		}
+		writeUploadHeaders(w, info)
+		utils.WriteSuccess(w, info)
+	case http.MethodDelete:
+		if err := h.uploadService.DeleteUpload(id); err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		utils.WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// create starts an upload described either by a JSON body or, for tus
+// clients, by the Upload-Length and Upload-Metadata headers. A tus request
+// may carry the first chunk in its body.
+func (h *UploadHandler) create(w http.ResponseWriter, r *http.Request) {
+	var req model.UploadRequest
+	withData := false
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else {
+		if r.Header.Get("Upload-Defer-Length") != "" {
+			utils.WriteError(w, http.StatusBadRequest, "Upload-Defer-Length is not supported")
+			return
+		}
+		size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, "Upload-Length header required")
+			return
+		}
+		metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		req = model.UploadRequest{
+			Filename: metadata["filename"],
+			Path:     metadata["path"],
+			Size:     size,
+			SHA256:   metadata["sha256"],
+		}
+		withData = r.Header.Get("Content-Type") == tusContentType
+	}
+
+	info, err := h.uploadService.CreateUpload(&req)
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		writeServiceError(w, err)
 		return
 	}
+	if info.Status == service.UploadStatusCompleted {
+		h.metricsService.IncrementUpload()
+	}
+
+	if withData {
+		written, err := h.uploadService.WriteChunk(info.ID, 0, true, r.Body)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		if written.Status == service.UploadStatusCompleted {
+			h.metricsService.IncrementUpload()
+		}
+		info = written
+	}
 
-	h.metricsService.IncrementUpload()
-	utils.WriteSuccess(w, map[string]string{
-		"status": "success",
-		"path":   dst,
-	})
+	w.Header().Set("Location", "/uploads/"+info.ID)
+	writeUploadHeaders(w, info)
+	utils.WriteJSON(w, http.StatusCreated, info)
+}
+
+// write stores the request body at the offset given by the Upload-Offset
+// header and reports whether it succeeded; on failure the error response has
+// been written
+func (h *UploadHandler) write(w http.ResponseWriter, r *http.Request, id string, sequential bool) (*model.UploadInfo, bool) {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Upload-Offset header required")
+		return nil, false
+	}
+
+	info, err := h.uploadService.WriteChunk(id, offset, sequential, r.Body)
+	if err != nil {
+		writeServiceError(w, err)
+		return nil, false
+	}
+	if info.Status == service.UploadStatusCompleted && r.ContentLength != 0 {
+		h.metricsService.IncrementUpload()
+	}
+	return info, true
+}
+
+// checkTusVersion rejects requests for a tus version other than ours
+func (h *UploadHandler) checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if version := r.Header.Get("Tus-Resumable"); version != "" && version != tusVersion && r.Method != http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		utils.WriteError(w, http.StatusPreconditionFailed, fmt.Sprintf("unsupported tus version %s", version))
+		return false
+	}
+	return true
+}
+
+func writeUploadHeaders(w http.ResponseWriter, info *model.UploadInfo) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	w.Header().Set("Upload-Expires", info.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// parseUploadMetadata parses a tus Upload-Metadata header: comma-separated
+// pairs of a key and a base64-encoded value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %s", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
 }
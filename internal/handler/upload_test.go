@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"litterbox-agent/internal/config"
+	"litterbox-agent/internal/model"
+	"litterbox-agent/internal/service"
+)
+
+// newTestUploadHandler returns a handler for a new workspace; maxSize limits
+// the size of each uploaded file, 0 meaning no limit
+func newTestUploadHandler(t *testing.T, maxSize int64) (*UploadHandler, string) {
+	t.Helper()
+
+	fileService, dir := newTestFileService(t)
+	uploadService, err := service.NewUploadService(fileService, config.UploadConfig{
+		StagingDir: filepath.Join(dir, ".staging"),
+		SessionTTL: time.Hour,
+		MaxSize:    maxSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewUploadHandler(fileService, uploadService, service.NewMetricsService()), dir
+}
+
+// uploadPart is a form field, or a file part when filename is set
+type uploadPart struct {
+	field, filename string
+	content         []byte
+}
+
+func postUpload(t *testing.T, h *UploadHandler, parts []uploadPart) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range parts {
+		var w io.Writer
+		var err error
+		if part.filename != "" {
+			w, err = mw.CreateFormFile(part.field, part.filename)
+		} else {
+			w, err = mw.CreateFormField(part.field)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(part.content)
+	}
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	h.Handle(rec, req)
+	return rec
+}
+
+func TestUploadFieldsAfterFiles(t *testing.T) {
+	h, dir := newTestUploadHandler(t, 0)
+	target := filepath.Join(dir, "uploads")
+
+	rec := postUpload(t, h, []uploadPart{
+		{field: "file", filename: "a.txt", content: []byte("alpha")},
+		{field: "file", filename: "sub/b.txt", content: []byte("beta")},
+		{field: "path", content: []byte(target)},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp model.UploadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "success" || len(resp.Files) != 2 || resp.Bytes != 9 {
+		t.Errorf("response %s, want both files written", rec.Body)
+	}
+	for name, want := range map[string]string{"a.txt": "alpha", "sub/b.txt": "beta"} {
+		got, err := os.ReadFile(filepath.Join(target, name))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v; want %q in the path given after the file", name, got, err, want)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("a.txt was written to the default directory: %v", err)
+	}
+	if staged, _ := filepath.Glob(filepath.Join(dir, ".staging", "*")); len(staged) != 0 {
+		t.Errorf("staging files left behind: %v", staged)
+	}
+}
+
+func TestUploadExtractFieldsAfterFile(t *testing.T) {
+	h, dir := newTestUploadHandler(t, 0)
+	target := filepath.Join(dir, "project")
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "main.go", Mode: 0644, Size: 12})
+	tw.Write([]byte("package main"))
+	tw.Close()
+
+	rec := postUpload(t, h, []uploadPart{
+		{field: "file", filename: "project.tar", content: archive.Bytes()},
+		{field: "path", content: []byte(target)},
+		{field: "extract", content: []byte("true")},
+		{field: "format", content: []byte("tar")},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	got, err := os.ReadFile(filepath.Join(target, "main.go"))
+	if err != nil || string(got) != "package main" {
+		t.Errorf("main.go = %q, %v; want the archive extracted into the path given after the file", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "project.tar")); !os.IsNotExist(err) {
+		t.Errorf("archive was stored instead of extracted: %v", err)
+	}
+}
+
+func TestUploadFileTooLarge(t *testing.T) {
+	h, dir := newTestUploadHandler(t, 8)
+
+	rec := postUpload(t, h, []uploadPart{
+		{field: "file", filename: "small.txt", content: []byte("12345678")},
+		{field: "file", filename: "large.txt", content: []byte("123456789")},
+	})
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d: %s, want 413", rec.Code, rec.Body)
+	}
+	for _, name := range []string{"small.txt", "large.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was written although the upload was rejected: %v", name, err)
+		}
+	}
+	if staged, _ := filepath.Glob(filepath.Join(dir, ".staging", "*")); len(staged) != 0 {
+		t.Errorf("staging files left behind: %v", staged)
+	}
+}
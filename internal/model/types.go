@@ -1,15 +1,121 @@
 package model
 
+import "time"
+
 // CommandRequest represents a command execution request
 type CommandRequest struct {
-	Command string `json:"command"`
+	Command       string            `json:"command,omitempty"`        // 通过 sh -c 执行的命令
+	Argv          []string          `json:"argv,omitempty"`           // 不经过 shell 直接执行的参数列表，与 command 二选一
+	TimeoutMs     int64             `json:"timeout_ms,omitempty"`     // 超时时间（毫秒），0 表示使用默认值
+	Cwd           string            `json:"cwd,omitempty"`            // 工作目录
+	Env           map[string]string `json:"env,omitempty"`            // 环境变量，默认合并到 agent 的环境中
+	ReplaceEnv    bool              `json:"replace_env,omitempty"`    // 为 true 时仅使用 env 中的变量
+	Stdin         string            `json:"stdin,omitempty"`          // 标准输入内容
+	StdinEncoding string            `json:"stdin_encoding,omitempty"` // stdin 编码: text（默认）或 base64
+	User          string            `json:"user,omitempty"`           // 运行命令的用户（用户名或 uid）
+	Group         string            `json:"group,omitempty"`          // 运行命令的组（组名或 gid），默认为用户的主组
+	Limits        *ResourceLimits   `json:"limits,omitempty"`         // 资源限制，未设置的项使用 agent 默认值
+}
+
+// ResourceLimits represents the resource limits of a command
+type ResourceLimits struct {
+	CPUs        float64 `json:"cpus,omitempty"`         // CPU 配额（核数），如 0.5
+	MemoryBytes int64   `json:"memory_bytes,omitempty"` // 内存上限（字节）
+	Pids        int64   `json:"pids,omitempty"`         // 最大进程数
 }
 
 // CommandResponse represents a command execution response
 type CommandResponse struct {
-	Stdout   string `json:"stdout"`
-	Stderr   string `json:"stderr"`
-	ExitCode int    `json:"exit_code"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	ExitCode   int    `json:"exit_code"`
+	TimedOut   bool   `json:"timed_out"`   // 是否因超时被终止
+	DurationMs int64  `json:"duration_ms"` // 执行耗时（毫秒）
+
+	StdoutTruncated bool  `json:"stdout_truncated"` // stdout 是否超出限制被截断
+	StderrTruncated bool  `json:"stderr_truncated"` // stderr 是否超出限制被截断
+	StdoutBytes     int64 `json:"stdout_bytes"`     // stdout 总字节数（含被截断部分）
+	StderrBytes     int64 `json:"stderr_bytes"`     // stderr 总字节数（含被截断部分）
+
+	PeakMemoryBytes int64  `json:"peak_memory_bytes"`    // 内存峰值（字节）
+	CPUTimeMs       int64  `json:"cpu_time_ms"`          // 消耗的 CPU 时间（毫秒）
+	LimitMode       string `json:"limit_mode,omitempty"` // 资源限制方式: cgroup 或 rlimit
+
+	AppliedLimits *ResourceLimits `json:"applied_limits,omitempty"` // 实际生效的资源限制
+}
+
+// ExecStreamEvent represents a single Server-Sent Event of a streamed command
+type ExecStreamEvent struct {
+	Seq        uint64 `json:"seq"`                   // 事件序号，从 1 开始递增
+	Type       string `json:"type"`                  // stdout, stderr, exit
+	Timestamp  int64  `json:"timestamp"`             // Unix 时间戳（毫秒）
+	Data       string `json:"data,omitempty"`        // stdout/stderr: 输出片段
+	Encoding   string `json:"encoding,omitempty"`    // stdout/stderr: 为 base64 时 data 是 base64 编码的原始字节
+	ExitCode   *int   `json:"exit_code,omitempty"`   // exit: 退出码
+	TimedOut   bool   `json:"timed_out,omitempty"`   // exit: 是否因超时被终止
+	DurationMs int64  `json:"duration_ms,omitempty"` // exit: 执行耗时（毫秒）
+	Error      string `json:"error,omitempty"`       // exit: 启动失败等错误信息
+
+	PeakMemoryBytes int64  `json:"peak_memory_bytes,omitempty"` // exit: 内存峰值（字节）
+	CPUTimeMs       int64  `json:"cpu_time_ms,omitempty"`       // exit: 消耗的 CPU 时间（毫秒）
+	LimitMode       string `json:"limit_mode,omitempty"`        // exit: 资源限制方式
+
+	AppliedLimits *ResourceLimits `json:"applied_limits,omitempty"` // exit: 实际生效的资源限制
+}
+
+// JobInfo represents the state of a background job
+type JobInfo struct {
+	ID            string     `json:"id"`
+	Command       string     `json:"command,omitempty"`
+	Argv          []string   `json:"argv,omitempty"`
+	Status        string     `json:"status"` // running, exited, killed, timed_out, failed
+	Pid           int        `json:"pid,omitempty"`
+	ExitCode      *int       `json:"exit_code,omitempty"`
+	TimedOut      bool       `json:"timed_out"`
+	Error         string     `json:"error,omitempty"`
+	StartedAt     time.Time  `json:"started_at"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	DurationMs    int64      `json:"duration_ms"`
+	Stdout        string     `json:"stdout,omitempty"`         // 仅在查询单个任务时返回
+	Stderr        string     `json:"stderr,omitempty"`         // 仅在查询单个任务时返回
+	StdoutDropped int64      `json:"stdout_dropped,omitempty"` // 超出缓冲区被丢弃的字节数
+	StderrDropped int64      `json:"stderr_dropped,omitempty"` // 超出缓冲区被丢弃的字节数
+
+	PeakMemoryBytes int64  `json:"peak_memory_bytes,omitempty"` // 结束后: 内存峰值（字节）
+	CPUTimeMs       int64  `json:"cpu_time_ms,omitempty"`       // 结束后: 消耗的 CPU 时间（毫秒）
+	LimitMode       string `json:"limit_mode,omitempty"`        // 资源限制方式: cgroup 或 rlimit
+
+	AppliedLimits *ResourceLimits `json:"applied_limits,omitempty"` // 实际生效的资源限制
+}
+
+// SessionRequest represents a request to create a persistent shell session
+type SessionRequest struct {
+	Name       string            `json:"name,omitempty"`        // 会话名称（可选，仅用于展示）
+	Cwd        string            `json:"cwd,omitempty"`         // 初始工作目录
+	Env        map[string]string `json:"env,omitempty"`         // 初始环境变量，默认合并到 agent 的环境中
+	ReplaceEnv bool              `json:"replace_env,omitempty"` // 为 true 时仅使用 env 中的变量
+	User       string            `json:"user,omitempty"`        // 运行 shell 的用户（用户名或 uid）
+	Group      string            `json:"group,omitempty"`       // 运行 shell 的组（组名或 gid）
+}
+
+// SessionInfo represents the state of a persistent shell session
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name,omitempty"`
+	Pid        int       `json:"pid"`
+	Alive      bool      `json:"alive"`
+	ExitCode   *int      `json:"exit_code,omitempty"` // shell 已退出时的退出码
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// PtyMessage represents a JSON control message on the /pty WebSocket
+type PtyMessage struct {
+	Type     string `json:"type"`                // input, resize (客户端); exit, error (服务端)
+	Data     string `json:"data,omitempty"`      // input: 键盘输入; error: 错误信息
+	Rows     uint16 `json:"rows,omitempty"`      // resize: 行数
+	Cols     uint16 `json:"cols,omitempty"`      // resize: 列数
+	ExitCode *int   `json:"exit_code,omitempty"` // exit: shell 退出码
 }
 
 // Metrics represents system metrics
@@ -28,13 +134,47 @@ type Metrics struct {
 
 // FileOperationRequest represents a unified file operation request
 type FileOperationRequest struct {
-	Command    string `json:"command"`               // view, create, str_replace, insert, undo_edit
+	Command    string `json:"command"`               // view, create, str_replace, insert, undo_edit, list
 	Path       string `json:"path"`                  // 文件路径
 	FileText   string `json:"file_text,omitempty"`   // create: 文件内容
 	ViewRange  []int  `json:"view_range,omitempty"`  // view: [start_line, end_line]
 	OldStr     string `json:"old_str,omitempty"`     // str_replace: 要替换的字符串
 	NewStr     string `json:"new_str,omitempty"`     // str_replace/insert: 新字符串
 	InsertLine int    `json:"insert_line,omitempty"` // insert: 插入位置
+	ReplaceAll bool   `json:"replace_all,omitempty"` // str_replace: 替换所有匹配，默认要求 old_str 唯一
+	Occurrence int    `json:"occurrence,omitempty"`  // str_replace: 只替换第几处匹配（从 1 开始）
+
+	Edits []FileEdit `json:"edits,omitempty"` // multi_edit: 依次执行的编辑
+
+	Patch  string `json:"patch,omitempty"`   // apply_patch: unified diff，可包含多个文件
+	DryRun bool   `json:"dry_run,omitempty"` // apply_patch: 只检查各 hunk 能否应用，不写入文件
+	Fuzz   *int   `json:"fuzz,omitempty"`    // apply_patch: 匹配时最多忽略的首尾上下文行数，默认 2
+
+	FollowSymlinks *bool  `json:"follow_symlinks,omitempty"` // create/str_replace/insert/undo_edit: 是否写入符号链接的目标而不是替换链接，默认 true
+	IfMatch        string `json:"if_match,omitempty"`        // create/str_replace/insert/undo_edit: 文件的 etag 与之不同时拒绝修改
+
+	MaxDepth         int  `json:"max_depth,omitempty"`         // list: 最大深度，默认 1
+	ShowHidden       bool `json:"show_hidden,omitempty"`       // list: 是否包含隐藏文件
+	RespectGitignore bool `json:"respect_gitignore,omitempty"` // list: 是否跳过 .gitignore 忽略的文件
+
+	Destination string `json:"destination,omitempty"` // move/copy: 目标路径
+	Recursive   bool   `json:"recursive,omitempty"`   // delete/copy/chmod: 是否递归处理目录
+	Overwrite   bool   `json:"overwrite,omitempty"`   // move/copy/create: 目标已存在时是否覆盖
+	Mode        string `json:"mode,omitempty"`        // chmod/mkdir: 八进制权限，如 0755
+
+	Pattern         string   `json:"pattern,omitempty"`          // search: 正则表达式; find: glob
+	Literal         bool     `json:"literal,omitempty"`          // search: 将 pattern 作为普通字符串匹配
+	Include         []string `json:"include,omitempty"`          // search/find: 只返回匹配这些 glob 的文件
+	Exclude         []string `json:"exclude,omitempty"`          // search/find: 跳过匹配这些 glob 的文件和目录
+	CaseInsensitive bool     `json:"case_insensitive,omitempty"` // search: 忽略大小写
+	ContextLines    int      `json:"context_lines,omitempty"`    // search: 匹配行前后返回的行数
+	MaxResults      int      `json:"max_results,omitempty"`      // search/find: 最多返回的结果数，默认 1000
+
+	Type           string     `json:"type,omitempty"`            // find: file, dir, symlink, other
+	MinSize        int64      `json:"min_size,omitempty"`        // find: 最小字节数
+	MaxSize        int64      `json:"max_size,omitempty"`        // find: 最大字节数
+	ModifiedAfter  *time.Time `json:"modified_after,omitempty"`  // find: 修改时间晚于
+	ModifiedBefore *time.Time `json:"modified_before,omitempty"` // find: 修改时间早于
 }
 
 // FileOperationResponse represents a unified file operation response
@@ -43,9 +183,131 @@ type FileOperationResponse struct {
 	Content string `json:"content,omitempty"` // view: 文件内容
 	Message string `json:"message,omitempty"` // 操作结果消息
 	Lines   int    `json:"lines,omitempty"`   // view: 总行数
+	ETag    string `json:"etag,omitempty"`    // view 及编辑命令: 文件内容的版本标识
+
+	MatchLines []int `json:"match_lines,omitempty"` // str_replace: old_str 所有匹配所在的行号
+	FailedEdit *int  `json:"failed_edit,omitempty"` // multi_edit: 失败的编辑在 edits 中的序号（从 0 开始）
+
+	Files []*PatchFileResult `json:"files,omitempty"` // apply_patch: 每个文件的应用结果
+
+	Entries   []*FileEntry `json:"entries,omitempty"`   // list: 目录项
+	Truncated bool         `json:"truncated,omitempty"` // list: 结果是否因数量限制被截断
+	Entry     *FileEntry   `json:"entry,omitempty"`     // stat: 文件信息
+
+	Matches []*SearchMatch `json:"matches,omitempty"` // search: 匹配结果
+}
+
+// FileEdit represents one edit of a multi_edit command
+type FileEdit struct {
+	Command    string `json:"command"`               // str_replace, insert
+	OldStr     string `json:"old_str,omitempty"`     // str_replace: 要替换的字符串
+	NewStr     string `json:"new_str,omitempty"`     // str_replace/insert: 新字符串
+	ReplaceAll bool   `json:"replace_all,omitempty"` // str_replace: 替换所有匹配
+	Occurrence int    `json:"occurrence,omitempty"`  // str_replace: 只替换第几处匹配（从 1 开始）
+	InsertLine int    `json:"insert_line,omitempty"` // insert: 插入位置
+}
+
+// PatchFileResult represents the outcome of applying the part of a patch that
+// touches one file
+type PatchFileResult struct {
+	Path   string             `json:"path"`            // 文件路径
+	Action string             `json:"action"`          // modify, create, delete
+	Hunks  []*PatchHunkResult `json:"hunks,omitempty"` // 各 hunk 的应用结果
+	ETag   string             `json:"etag,omitempty"`  // 修改或创建后文件内容的版本标识
+	Error  string             `json:"error,omitempty"` // 无法应用的原因
+}
+
+// PatchHunkResult represents the outcome of applying one hunk of a patch
+type PatchHunkResult struct {
+	Index   int    `json:"index"`            // hunk 在文件中的序号（从 1 开始）
+	Applied bool   `json:"applied"`          // 是否能够应用
+	Line    int    `json:"line,omitempty"`   // 应用位置的起始行号
+	Offset  int    `json:"offset,omitempty"` // 实际位置与 hunk 头中行号的差
+	Fuzz    int    `json:"fuzz,omitempty"`   // 匹配时忽略的首尾上下文行数
+	Error   string `json:"error,omitempty"`  // 无法应用的原因
+}
+
+// SearchMatch represents a line found by the search command
+type SearchMatch struct {
+	Path   string   `json:"path"`
+	Line   int      `json:"line"`             // 行号，从 1 开始
+	Column int      `json:"column"`           // 第一处匹配的字节偏移，从 1 开始
+	Text   string   `json:"text"`             // 匹配行的内容
+	Before []string `json:"before,omitempty"` // 匹配行之前的上下文
+	After  []string `json:"after,omitempty"`  // 匹配行之后的上下文
+}
+
+// FileEntry represents a file or directory in a listing
+type FileEntry struct {
+	Name       string    `json:"name"`                  // 相对于所列目录的路径
+	Path       string    `json:"path"`                  // 绝对路径
+	Type       string    `json:"type"`                  // file, dir, symlink, other
+	Size       int64     `json:"size"`                  // 字节数
+	Mode       string    `json:"mode"`                  // 权限位，如 0644
+	ModTime    time.Time `json:"mtime"`                 // 最后修改时间
+	LinkTarget string    `json:"link_target,omitempty"` // symlink: 链接目标
+}
+
+// UploadResponse represents the result of a multipart upload
+type UploadResponse struct {
+	Status string          `json:"status"`         // success, partial, failed
+	Path   string          `json:"path,omitempty"` // 只上传一个文件时为其路径
+	Files  []*UploadedFile `json:"files"`
+	Bytes  int64           `json:"bytes"` // 写入的总字节数
+}
+
+// UploadedFile represents one file part of a multipart upload
+type UploadedFile struct {
+	Name   string `json:"name"`             // 客户端提供的文件名，可以包含相对路径
+	Path   string `json:"path,omitempty"`   // 写入的路径，解压时为解压目录
+	Size   int64  `json:"size"`             // 写入的字节数
+	Format string `json:"format,omitempty"` // 解压时的归档格式
+	Files  int    `json:"files,omitempty"`  // 解压时写入的文件数
+	Error  string `json:"error,omitempty"`
+	Code   string `json:"code,omitempty"`
+}
+
+// ExtractResponse represents the result of extracting an uploaded archive
+type ExtractResponse struct {
+	Status string `json:"status"`
+	Path   string `json:"path"`   // 解压目标目录
+	Format string `json:"format"` // tar, tar.gz, zip
+	Files  int    `json:"files"`  // 写入的文件数（含符号链接和硬链接，不含目录）
+	Bytes  int64  `json:"bytes"`  // 写入的总字节数
+}
+
+// UploadRequest represents a request to create a resumable upload
+type UploadRequest struct {
+	Filename string `json:"filename"`
+	Path     string `json:"path,omitempty"`   // 目标目录，与 /upload 的 path 相同
+	Size     int64  `json:"size"`             // 文件总字节数
+	SHA256   string `json:"sha256,omitempty"` // 完成时校验的十六进制 SHA-256
+}
+
+// ByteRange represents a range of received bytes; End is exclusive
+type ByteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// UploadInfo represents the state of a resumable upload
+type UploadInfo struct {
+	ID          string      `json:"id"`
+	Filename    string      `json:"filename"`
+	Path        string      `json:"path"` // 完成后文件的路径
+	Size        int64       `json:"size"`
+	Offset      int64       `json:"offset"`   // 从 0 开始连续收到的字节数
+	Received    int64       `json:"received"` // 收到的总字节数
+	Ranges      []ByteRange `json:"ranges"`   // 已收到的字节区间
+	SHA256      string      `json:"sha256,omitempty"`
+	Status      string      `json:"status"` // uploading, completed
+	CreatedAt   time.Time   `json:"created_at"`
+	ExpiresAt   time.Time   `json:"expires_at"`
+	CompletedAt *time.Time  `json:"completed_at,omitempty"`
 }
 
 // ErrorResponse represents an error response
 type ErrorResponse struct {
 	Error string `json:"error"`
+	Code  string `json:"code,omitempty"` // 机器可读的错误码
 }
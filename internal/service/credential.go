@@ -0,0 +1,159 @@
+package service
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// execUser is a Unix account that commands can be run as
+type execUser struct {
+	uid    uint32
+	gid    uint32
+	groups []uint32
+	name   string
+	home   string
+}
+
+// resolveUser determines the account a command should run as. userSpec and
+// groupSpec may be names or numeric ids; when userSpec is empty the configured
+// default user is used. It returns nil if the command should run as the agent.
+//
+// When a default user is configured, a request may not run commands as root
+// or with the root group unless AllowPrivilegedUser is set, since the default
+// exists to keep untrusted commands unprivileged.
+func (s *ExecService) resolveUser(userSpec, groupSpec string) (*execUser, error) {
+	if userSpec == "" {
+		userSpec = s.cfg.DefaultUser
+	}
+	if userSpec == "" {
+		if groupSpec != "" {
+			return nil, newError(CodeInvalidRequest, "group requires user")
+		}
+		return nil, nil
+	}
+
+	u, err := lookupUser(userSpec, groupSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	// 只有 root 才能切换到其他用户
+	if euid := os.Geteuid(); euid != 0 && int(u.uid) != euid {
+		return nil, newError(CodePermissionDenied, "agent is not running as root and cannot run commands as %s", userSpec)
+	}
+
+	if s.cfg.DefaultUser != "" && !s.cfg.AllowPrivilegedUser {
+		def, err := lookupUser(s.cfg.DefaultUser, "")
+		if err != nil {
+			return nil, err
+		}
+		if (u.uid == 0 && def.uid != 0) || (u.gid == 0 && def.gid != 0) {
+			return nil, newError(CodePermissionDenied, "running commands as %s is not allowed: the default user is %s", describeUser(userSpec, groupSpec), s.cfg.DefaultUser)
+		}
+	}
+
+	return u, nil
+}
+
+// describeUser formats a user and an optional group for error messages
+func describeUser(userSpec, groupSpec string) string {
+	if groupSpec == "" {
+		return userSpec
+	}
+	return userSpec + ":" + groupSpec
+}
+
+// lookupUser resolves a user and an optional group override from the
+// account database. Numeric ids that have no entry are used as-is.
+func lookupUser(userSpec, groupSpec string) (*execUser, error) {
+	u, err := user.Lookup(userSpec)
+	if err != nil {
+		if _, isNumeric := parseID(userSpec); isNumeric {
+			u, err = user.LookupId(userSpec)
+		}
+	}
+
+	var result *execUser
+	if err == nil {
+		uid, _ := parseID(u.Uid)
+		gid, _ := parseID(u.Gid)
+		result = &execUser{uid: uid, gid: gid, name: u.Username, home: u.HomeDir}
+
+		if groupIds, err := u.GroupIds(); err == nil {
+			for _, id := range groupIds {
+				if gid, ok := parseID(id); ok {
+					result.groups = append(result.groups, gid)
+				}
+			}
+		}
+	} else if uid, ok := parseID(userSpec); ok {
+		result = &execUser{uid: uid, gid: uid, name: userSpec, home: "/"}
+	} else {
+		return nil, newError(CodeUserNotFound, "user not found: %s", userSpec)
+	}
+
+	if groupSpec != "" {
+		gid, err := lookupGroup(groupSpec)
+		if err != nil {
+			return nil, err
+		}
+		result.gid = gid
+		result.groups = nil
+	}
+
+	return result, nil
+}
+
+func lookupGroup(groupSpec string) (uint32, error) {
+	g, err := user.LookupGroup(groupSpec)
+	if err == nil {
+		gid, _ := parseID(g.Gid)
+		return gid, nil
+	}
+	if gid, ok := parseID(groupSpec); ok {
+		return gid, nil
+	}
+	return 0, newError(CodeGroupNotFound, "group not found: %s", groupSpec)
+}
+
+func parseID(s string) (uint32, bool) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(id), true
+}
+
+// apply makes cmd run with the credentials of the account. Nothing changes
+// when the account is the agent's own; an agent that is not root cannot call
+// setgroups, so it keeps its supplementary groups.
+func (u *execUser) apply(cmd *exec.Cmd) {
+	if int(u.uid) == os.Geteuid() && int(u.gid) == os.Getegid() {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:         u.uid,
+		Gid:         u.gid,
+		Groups:      u.groups,
+		NoSetGroups: os.Geteuid() != 0,
+	}
+}
+
+// env returns the login variables of the account, overridden by overrides
+func (u *execUser) env(overrides map[string]string) map[string]string {
+	env := map[string]string{
+		"HOME":    u.home,
+		"USER":    u.name,
+		"LOGNAME": u.name,
+	}
+	for key, value := range overrides {
+		env[key] = value
+	}
+	return env
+}
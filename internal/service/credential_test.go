@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+
+	"litterbox-agent/internal/model"
+)
+
+func TestResolveUserRejectsPrivilegeAboveDefault(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching users requires root")
+	}
+	if _, err := lookupUser("nobody", ""); err != nil {
+		t.Skip("no nobody account")
+	}
+
+	s := newTestExecService()
+	s.cfg.DefaultUser = "nobody"
+
+	for _, tt := range []struct{ user, group string }{
+		{"root", ""},
+		{"0", ""},
+		{"", "0"},
+		{"nobody", "root"},
+	} {
+		_, err := s.resolveUser(tt.user, tt.group)
+		var serviceErr *Error
+		if !errors.As(err, &serviceErr) || serviceErr.Code != CodePermissionDenied {
+			t.Errorf("user %q, group %q: error = %v, want %s", tt.user, tt.group, err, CodePermissionDenied)
+		}
+	}
+
+	if u, err := s.resolveUser("", ""); err != nil || u == nil || u.name != "nobody" {
+		t.Errorf("default user = %+v, %v; want nobody", u, err)
+	}
+
+	s.cfg.AllowPrivilegedUser = true
+	if u, err := s.resolveUser("root", ""); err != nil || u.uid != 0 {
+		t.Errorf("root with AllowPrivilegedUser = %+v, %v; want uid 0", u, err)
+	}
+}
+
+func TestApplyOwnUserKeepsCredentials(t *testing.T) {
+	u := &execUser{uid: uint32(os.Geteuid()), gid: uint32(os.Getegid()), groups: []uint32{12345}}
+	cmd := exec.Command("true")
+	u.apply(cmd)
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Credential != nil {
+		t.Errorf("credential = %+v, want none for the agent's own user", cmd.SysProcAttr.Credential)
+	}
+
+	// 以 agent 自己的用户运行时，即使 agent 不是 root 也能启动命令
+	resp, err := newTestExecService().ExecuteCommand(context.Background(), &model.CommandRequest{
+		Command: "id -u",
+		User:    strconv.Itoa(os.Geteuid()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ExitCode != 0 || resp.Stdout != strconv.Itoa(os.Geteuid()) {
+		t.Errorf("exit code %d, stdout %q; want the agent's uid", resp.ExitCode, resp.Stdout)
+	}
+}
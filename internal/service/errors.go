@@ -0,0 +1,98 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// Error codes returned to API clients
+const (
+	CodeInvalidRequest = "INVALID_REQUEST"
+	CodeInvalidCwd     = "INVALID_CWD"
+
+	CodePermissionDenied = "PERMISSION_DENIED"
+	CodeUserNotFound     = "USER_NOT_FOUND"
+	CodeGroupNotFound    = "GROUP_NOT_FOUND"
+
+	CodeExecutableNotFound = "EXECUTABLE_NOT_FOUND"
+
+	CodePathOutsideWorkspace = "PATH_OUTSIDE_WORKSPACE"
+	CodePathNotAllowed       = "PATH_NOT_ALLOWED"
+
+	CodeNotFound      = "NOT_FOUND"
+	CodeAlreadyExists = "ALREADY_EXISTS"
+	CodeNotEmpty      = "NOT_EMPTY"
+	CodeNotDirectory  = "NOT_A_DIRECTORY"
+	CodeIsDirectory   = "IS_A_DIRECTORY"
+
+	CodeInvalidArchive = "INVALID_ARCHIVE"
+
+	CodeConflict = "CONFLICT"
+
+	CodeOffsetMismatch   = "OFFSET_MISMATCH"
+	CodeChecksumMismatch = "CHECKSUM_MISMATCH"
+	CodeTooLarge         = "TOO_LARGE"
+)
+
+// Error is a service error carrying a machine-readable code
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func newError(code, format string, args ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// classifyFSError converts common file system errors into coded errors, so
+// that clients can tell a missing file from a failure of the agent. Other
+// errors are returned unchanged.
+func classifyFSError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var serviceErr *Error
+	if errors.As(err, &serviceErr) {
+		return err
+	}
+
+	path := ""
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.As(err, &pathErr):
+		path = pathErr.Path
+	case errors.As(err, &linkErr):
+		path = linkErr.Old
+	}
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return newError(CodeNotFound, "no such file or directory: %s", path)
+	case errors.Is(err, fs.ErrPermission):
+		return newError(CodePermissionDenied, "permission denied: %s", path)
+	case errors.Is(err, syscall.ENOTEMPTY):
+		// 须在 ErrExist 之前判断，ENOTEMPTY 也被视为 ErrExist
+		return newError(CodeNotEmpty, "directory not empty: %s", path)
+	case errors.Is(err, fs.ErrExist):
+		return newError(CodeAlreadyExists, "file already exists: %s", path)
+	case errors.Is(err, syscall.ENOTDIR):
+		return newError(CodeNotDirectory, "not a directory: %s", path)
+	case errors.Is(err, syscall.EISDIR):
+		return newError(CodeIsDirectory, "is a directory: %s", path)
+	case errors.Is(err, syscall.ELOOP):
+		// 路径在检查之后被替换成了符号链接
+		return newError(CodePathNotAllowed, "path contains a symlink that is not followed: %s", path)
+	}
+	return err
+}
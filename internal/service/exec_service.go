@@ -2,40 +2,522 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
+	"litterbox-agent/internal/config"
 	"litterbox-agent/internal/model"
 )
 
-type ExecService struct{}
+type ExecService struct {
+	cfg config.ExecConfig
+}
+
+func NewExecService(cfg config.ExecConfig) *ExecService {
+	return &ExecService{
+		cfg: cfg,
+	}
+}
+
+// runResult describes how a started command finished
+type runResult struct {
+	exitCode int
+	timedOut bool
+	duration time.Duration
+	err      error // 非退出码类的错误（如启动失败）
 
-func NewExecService() *ExecService {
-	return &ExecService{}
+	usage         resourceUsage
+	limitMode     string
+	appliedLimits *model.ResourceLimits
 }
 
 // ExecuteCommand executes a shell command and returns the result
-func (s *ExecService) ExecuteCommand(command string) *model.CommandResponse {
-	cmd := exec.Command("sh", "-c", command)
+func (s *ExecService) ExecuteCommand(ctx context.Context, req *model.CommandRequest) (*model.CommandResponse, error) {
+	cmd, rg, err := s.buildCommand(req)
+	if err != nil {
+		return nil, err
+	}
+
+	stdout := s.newOutputBuffer()
+	stderr := s.newOutputBuffer()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	result := s.run(ctx, cmd, rg, s.timeout(req.TimeoutMs))
+	if result.err != nil {
+		// 捕获特殊异常
+		stderr.Write([]byte(result.err.Error()))
+	}
+
+	return &model.CommandResponse{
+		Stdout:          strings.TrimRight(stdout.String(), "\n"),
+		Stderr:          strings.TrimRight(stderr.String(), "\n"),
+		ExitCode:        result.exitCode,
+		TimedOut:        result.timedOut,
+		DurationMs:      result.duration.Milliseconds(),
+		StdoutTruncated: stdout.Truncated(),
+		StderrTruncated: stderr.Truncated(),
+		StdoutBytes:     stdout.Total(),
+		StderrBytes:     stderr.Total(),
+		PeakMemoryBytes: result.usage.peakMemoryBytes,
+		CPUTimeMs:       result.usage.cpuTime.Milliseconds(),
+		LimitMode:       result.limitMode,
+		AppliedLimits:   result.appliedLimits,
+	}, nil
+}
+
+// StreamCommand executes a shell command like ExecuteCommand, but delivers
+// stdout and stderr chunks to emit as they are produced. The final event has
+// type "exit" and carries the exit code. Calls to emit are serialized.
+// started is called once the request has been validated, before any event is
+// emitted; if the request is invalid an error is returned instead.
+func (s *ExecService) StreamCommand(ctx context.Context, req *model.CommandRequest, started func(), emit func(*model.ExecStreamEvent)) error {
+	cmd, rg, err := s.buildCommand(req)
+	if err != nil {
+		return err
+	}
+	started()
+
+	stream := &eventStream{emit: emit}
+	stdout := &streamWriter{stream: stream, typ: "stdout"}
+	stderr := &streamWriter{stream: stream, typ: "stderr"}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	result := s.run(ctx, cmd, rg, s.timeout(req.TimeoutMs))
+	stdout.flush()
+	stderr.flush()
+
+	exitCode := result.exitCode
+	event := &model.ExecStreamEvent{
+		Type:       "exit",
+		ExitCode:   &exitCode,
+		TimedOut:   result.timedOut,
+		DurationMs: result.duration.Milliseconds(),
 
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+		PeakMemoryBytes: result.usage.peakMemoryBytes,
+		CPUTimeMs:       result.usage.cpuTime.Milliseconds(),
+		LimitMode:       result.limitMode,
+		AppliedLimits:   result.appliedLimits,
+	}
+	if result.err != nil {
+		event.Error = result.err.Error()
+	}
+	stream.send(event)
+	return nil
+}
+
+// eventStream assigns sequence numbers and timestamps to stream events
+type eventStream struct {
+	mu   sync.Mutex
+	seq  uint64
+	emit func(*model.ExecStreamEvent)
+}
 
-	exitCode := 0
-	if err := cmd.Run(); err != nil {
+func (e *eventStream) send(event *model.ExecStreamEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.seq++
+	event.Seq = e.seq
+	event.Timestamp = time.Now().UnixMilli()
+	e.emit(event)
+}
+
+// streamWriter forwards everything written to it as stream events. A UTF-8
+// character split between two writes is held back until it is complete, and
+// output that is not valid UTF-8 is sent base64-encoded.
+type streamWriter struct {
+	stream  *eventStream
+	typ     string
+	pending []byte // 上次写入末尾不完整的 UTF-8 字符
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	data := append(w.pending, p...)
+	w.pending = nil
+	if n := incompleteRuneSuffix(data); n > 0 {
+		w.pending = append([]byte(nil), data[len(data)-n:]...)
+		data = data[:len(data)-n]
+	}
+	w.send(data)
+	return len(p), nil
+}
+
+// flush sends the bytes still held back once the output has ended
+func (w *streamWriter) flush() {
+	w.send(w.pending)
+	w.pending = nil
+}
+
+func (w *streamWriter) send(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	event := &model.ExecStreamEvent{Type: w.typ}
+	if utf8.Valid(data) {
+		event.Data = string(data)
+	} else {
+		event.Data = base64.StdEncoding.EncodeToString(data)
+		event.Encoding = "base64"
+	}
+	w.stream.send(event)
+}
+
+// incompleteRuneSuffix returns the length of the UTF-8 sequence at the end of
+// p that has been started but not completed, or 0 if there is none
+func incompleteRuneSuffix(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i > len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if utf8.FullRune(p[i:]) {
+				return 0
+			}
+			return len(p) - i
+		}
+	}
+	return 0
+}
+
+// buildCommand prepares the exec.Cmd for a request. In argv mode the binary
+// is executed directly, otherwise the command is run by `sh -c`. The returned
+// resourceGroup is nil when no resource limits apply.
+func (s *ExecService) buildCommand(req *model.CommandRequest) (*exec.Cmd, *resourceGroup, error) {
+	name, args := "sh", []string{"-c", req.Command}
+	if len(req.Argv) > 0 {
+		name, args = req.Argv[0], req.Argv[1:]
+	}
+	cmd := s.command(name, args...)
+
+	limits, err := s.effectiveLimits(req.Limits)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := s.applyUserEnvironment(cmd, req.User, req.Group, req.Cwd, req.Env, req.ReplaceEnv); err != nil {
+		return nil, nil, err
+	}
+
+	if len(req.Argv) > 0 {
+		// 按请求的 PATH 和工作目录解析可执行文件
+		path, err := lookPath(name, cmd.Dir, cmd.Env)
+		if err != nil {
+			return nil, nil, newError(CodeExecutableNotFound, "executable not found: %s", name)
+		}
+		cmd.Path = path
+		cmd.Err = nil
+	}
+
+	if req.Stdin != "" {
+		stdin, err := decodeStdin(req.Stdin, req.StdinEncoding)
+		if err != nil {
+			return nil, nil, err
+		}
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	// 最后创建 cgroup，避免前面的校验失败后遗留空目录
+	rg, err := s.newResourceGroup(cmd, limits)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cmd, rg, nil
+}
+
+// applyUserEnvironment sets the credentials, working directory and
+// environment of cmd. When the command runs as another user, HOME, USER and
+// LOGNAME are set for that account unless env overrides them.
+func (s *ExecService) applyUserEnvironment(cmd *exec.Cmd, userSpec, groupSpec, cwd string, env map[string]string, replace bool) error {
+	u, err := s.resolveUser(userSpec, groupSpec)
+	if err != nil {
+		return err
+	}
+	if u != nil {
+		u.apply(cmd)
+		env = u.env(env)
+	}
+	return applyEnvironment(cmd, cwd, env, replace)
+}
+
+// applyEnvironment sets the working directory and environment of cmd. The
+// variables in env are merged into the agent's environment unless replace is set.
+func applyEnvironment(cmd *exec.Cmd, cwd string, env map[string]string, replace bool) error {
+	if cwd != "" {
+		info, err := os.Stat(cwd)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return newError(CodeInvalidCwd, "cwd does not exist: %s", cwd)
+			}
+			return newError(CodeInvalidCwd, "cwd is not accessible: %v", err)
+		}
+		if !info.IsDir() {
+			return newError(CodeInvalidCwd, "cwd is not a directory: %s", cwd)
+		}
+		cmd.Dir = cwd
+	}
+
+	if len(env) == 0 && !replace {
+		return nil
+	}
+
+	var base []string
+	if !replace {
+		base = os.Environ()
+	}
+	cmd.Env = mergeEnv(base, env)
+	return nil
+}
+
+// lookPath resolves an executable like a shell would: names containing a
+// slash are used as-is (relative to dir), other names are searched in the PATH
+// from env, falling back to the agent's PATH when env is nil
+func lookPath(name, dir string, env []string) (string, error) {
+	if strings.Contains(name, "/") {
+		if err := checkExecutable(name, dir); err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+
+	pathEnv := os.Getenv("PATH")
+	if env != nil {
+		pathEnv = ""
+		for _, kv := range env {
+			if value, ok := strings.CutPrefix(kv, "PATH="); ok {
+				pathEnv = value
+			}
+		}
+	}
+
+	for _, pathDir := range filepath.SplitList(pathEnv) {
+		if pathDir == "" {
+			pathDir = "."
+		}
+		path := filepath.Join(pathDir, name)
+		if checkExecutable(path, dir) == nil {
+			return path, nil
+		}
+	}
+	return "", exec.ErrNotFound
+}
+
+// checkExecutable reports whether path, relative to dir, is an executable file
+func checkExecutable(path, dir string) error {
+	if !filepath.IsAbs(path) && dir != "" {
+		path = filepath.Join(dir, path)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// mergeEnv returns base with the variables in overrides added or replaced
+func mergeEnv(base []string, overrides map[string]string) []string {
+	merged := make([]string, 0, len(base)+len(overrides))
+	for _, kv := range base {
+		key, _, _ := strings.Cut(kv, "=")
+		if _, ok := overrides[key]; !ok {
+			merged = append(merged, kv)
+		}
+	}
+
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		merged = append(merged, key+"="+overrides[key])
+	}
+	return merged
+}
+
+// decodeStdin decodes the stdin field of a request according to its encoding
+func decodeStdin(stdin, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", "text":
+		return []byte(stdin), nil
+	case "base64":
+		data, err := base64.StdEncoding.DecodeString(stdin)
+		if err != nil {
+			return nil, newError(CodeInvalidRequest, "invalid base64 stdin: %v", err)
+		}
+		return data, nil
+	default:
+		return nil, newError(CodeInvalidRequest, "unsupported stdin_encoding: %s", encoding)
+	}
+}
+
+// outputDrainDelay is how long output is still collected after a command has
+// exited. Background processes it started, like `server &`, inherit its
+// stdout and stderr; their pipes are closed after this delay instead of being
+// waited for.
+const outputDrainDelay = 500 * time.Millisecond
+
+// command creates an exec.Cmd that runs in its own process group, so that it
+// can be killed together with its children
+func (s *ExecService) command(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.WaitDelay = outputDrainDelay
+	return cmd
+}
+
+// newOutputBuffer creates a buffer for one output stream using the
+// configured head and tail limits
+func (s *ExecService) newOutputBuffer() *outputBuffer {
+	return newOutputBuffer(s.cfg.OutputHeadBytes, s.cfg.OutputTailBytes)
+}
+
+// timeout returns the effective timeout for a request, applying the
+// configured default and maximum
+func (s *ExecService) timeout(timeoutMs int64) time.Duration {
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = s.cfg.DefaultTimeout
+	}
+	if s.cfg.MaxTimeout > 0 && timeout > s.cfg.MaxTimeout {
+		timeout = s.cfg.MaxTimeout
+	}
+	return timeout
+}
+
+// run starts cmd and waits for it to finish. When the timeout expires or ctx
+// is cancelled, the whole process group receives SIGTERM, followed by SIGKILL
+// after the configured grace period. A zero timeout means no deadline.
+func (s *ExecService) run(ctx context.Context, cmd *exec.Cmd, rg *resourceGroup, timeout time.Duration) runResult {
+	start := time.Now()
+	cmd, err := s.start(cmd, rg, timeout)
+	if err != nil {
+		return runResult{exitCode: 127, duration: time.Since(start), err: err}
+	}
+	return s.wait(ctx, cmd, rg, start, timeout)
+}
+
+// start starts cmd under the limits of rg and returns the command that was
+// started, which is a copy of cmd when it had to be started without its
+// cgroup
+func (s *ExecService) start(cmd *exec.Cmd, rg *resourceGroup, timeout time.Duration) (*exec.Cmd, error) {
+	started, err := rg.start(cmd, timeout)
+	if err != nil {
+		rg.finish(nil)
+		return nil, err
+	}
+	return started, nil
+}
+
+// wait waits for an already started cmd, enforcing the timeout and ctx
+// cancellation the same way as run. The resources used by the command are
+// collected and rg is released once it has exited.
+func (s *ExecService) wait(ctx context.Context, cmd *exec.Cmd, rg *resourceGroup, start time.Time, timeout time.Duration) runResult {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	var err error
+	timedOut := false
+	select {
+	case err = <-done:
+	case <-deadline:
+		if processExited(cmd.Process) {
+			// 命令本身已经结束，Wait 只是在等待后台进程占用的输出管道
+			err = <-done
+			break
+		}
+		timedOut = true
+		err = s.terminate(cmd, done)
+	case <-ctx.Done():
+		err = s.terminate(cmd, done)
+	}
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// 命令正常退出，只有输出管道在 WaitDelay 之后被关闭
+		err = nil
+	}
+
+	result := runResult{
+		timedOut:      timedOut,
+		duration:      time.Since(start),
+		usage:         rg.finish(cmd.ProcessState),
+		limitMode:     rg.mode(),
+		appliedLimits: rg.appliedLimits(),
+	}
+	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
-			exitCode = exitErr.ExitCode()
+			result.exitCode = exitErr.ExitCode()
 		} else {
-			// 捕获特殊异常
-			stderr.WriteString(err.Error())
-			exitCode = 127
+			result.exitCode = 127
+			result.err = err
 		}
 	}
+	return result
+}
 
-	return &model.CommandResponse{
-		Stdout:   strings.TrimRight(stdout.String(), "\n"),
-		Stderr:   strings.TrimRight(stderr.String(), "\n"),
-		ExitCode: exitCode,
+// terminate sends SIGTERM to the process group of cmd, escalating to SIGKILL
+// if it does not exit within the grace period, and returns the Wait error
+func (s *ExecService) terminate(cmd *exec.Cmd, done <-chan error) error {
+	signalGroup(cmd, syscall.SIGTERM)
+
+	grace := time.NewTimer(s.cfg.KillGrace)
+	defer grace.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-grace.C:
+		signalGroup(cmd, syscall.SIGKILL)
+		return <-done
+	}
+}
+
+// processExited reports whether the process has exited, either already
+// reaped by Wait, which then waits for the output pipes, or about to be
+func processExited(process *os.Process) bool {
+	if errors.Is(process.Signal(syscall.Signal(0)), os.ErrProcessDone) {
+		return true
+	}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", process.Pid))
+	if err != nil {
+		return false
+	}
+	// 第三个字段是进程状态，进程名可能包含空格和括号
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 || i+2 >= len(data) {
+		return false
+	}
+	state := data[i+2]
+	return state == 'Z' || state == 'X'
+}
+
+// signalGroup sends sig to every process in the process group led by cmd
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.Process == nil {
+		return nil
 	}
+	return syscall.Kill(-cmd.Process.Pid, sig)
 }
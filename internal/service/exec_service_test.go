@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"litterbox-agent/internal/config"
+	"litterbox-agent/internal/model"
+)
+
+func newTestExecService() *ExecService {
+	return NewExecService(config.ExecConfig{
+		DefaultTimeout:  time.Minute,
+		KillGrace:       time.Second,
+		OutputHeadBytes: 64 << 10,
+		OutputTailBytes: 64 << 10,
+	})
+}
+
+func TestExecuteCommandExit(t *testing.T) {
+	s := newTestExecService()
+
+	resp, err := s.ExecuteCommand(context.Background(), &model.CommandRequest{
+		Command: "echo out; echo err >&2; exit 3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ExitCode != 3 || resp.TimedOut {
+		t.Errorf("exit code %d, timed out %v; want 3, false", resp.ExitCode, resp.TimedOut)
+	}
+	if resp.Stdout != "out" || resp.Stderr != "err" {
+		t.Errorf("stdout %q, stderr %q; want \"out\", \"err\"", resp.Stdout, resp.Stderr)
+	}
+}
+
+func TestExecuteCommandTimeout(t *testing.T) {
+	s := newTestExecService()
+
+	start := time.Now()
+	resp, err := s.ExecuteCommand(context.Background(), &model.CommandRequest{
+		Command:   "echo started; sleep 10",
+		TimeoutMs: 200,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.TimedOut || resp.ExitCode != -1 {
+		t.Errorf("exit code %d, timed out %v; want -1, true", resp.ExitCode, resp.TimedOut)
+	}
+	if resp.Stdout != "started" {
+		t.Errorf("stdout %q, want the output written before the timeout", resp.Stdout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command returned after %v, want it killed at the timeout", elapsed)
+	}
+}
+
+func TestExecuteCommandBackgroundChild(t *testing.T) {
+	s := newTestExecService()
+
+	for _, timeoutMs := range []int64{0, 100} {
+		start := time.Now()
+		resp, err := s.ExecuteCommand(context.Background(), &model.CommandRequest{
+			// 后台进程继承了 stdout，命令本身立即退出
+			Command:   "sleep 3 & echo done",
+			TimeoutMs: timeoutMs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ExitCode != 0 || resp.TimedOut {
+			t.Errorf("timeout %dms: exit code %d, timed out %v; want 0, false", timeoutMs, resp.ExitCode, resp.TimedOut)
+		}
+		if resp.Stdout != "done" {
+			t.Errorf("timeout %dms: stdout %q, want \"done\"", timeoutMs, resp.Stdout)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("timeout %dms: command returned after %v, want it not to wait for the background process", timeoutMs, elapsed)
+		}
+	}
+}
+
+func TestStreamCommandSplitRunesAndBinary(t *testing.T) {
+	s := newTestExecService()
+
+	var events []*model.ExecStreamEvent
+	err := s.StreamCommand(context.Background(), &model.CommandRequest{
+		// "中" 的三个字节分两次写出，之后是不合法的 UTF-8
+		Command: `printf '\344'; sleep 0.2; printf '\270\255\n'; sleep 0.2; printf '\377\376'`,
+	}, func() {}, func(event *model.ExecStreamEvent) {
+		events = append(events, event)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout []byte
+	var texts []string
+	for _, event := range events {
+		if event.Type != "stdout" {
+			continue
+		}
+		if event.Encoding == "base64" {
+			data, err := base64.StdEncoding.DecodeString(event.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stdout = append(stdout, data...)
+		} else {
+			stdout = append(stdout, event.Data...)
+			texts = append(texts, event.Data)
+		}
+	}
+	if want := "中\n\xff\xfe"; string(stdout) != want {
+		t.Errorf("stdout = %q, want %q", stdout, want)
+	}
+	if len(texts) == 0 || texts[0] != "中\n" {
+		t.Errorf("text events = %q, want the split character sent whole as text", texts)
+	}
+}
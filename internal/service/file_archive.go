@@ -0,0 +1,630 @@
+package service
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"litterbox-agent/internal/model"
+)
+
+const (
+	ArchiveTar   = "tar"
+	ArchiveTarGz = "tar.gz"
+	ArchiveZip   = "zip"
+)
+
+// ExtractLimits bound the extraction of one archive
+type ExtractLimits struct {
+	StagingDir string // zip 需要先写入临时文件时使用的目录，为空时使用系统临时目录
+	MaxBytes   int64  // 解压出的文件总字节数上限，0 表示不限制
+	MaxEntries int    // 条目数上限，0 表示不限制
+}
+
+// ExtractArchive extracts a tar, tar.gz or zip archive into dir, creating it
+// if needed. format may be empty, in which case it is detected from the
+// content and the file name. File modes, symlinks and hard links are
+// preserved; entries that would end up outside dir, directly or through a
+// symlink, are rejected. Zip archives are read through io.ReaderAt when src
+// supports it and spooled to a temporary file in limits.StagingDir
+// otherwise. An archive with more entries or more uncompressed bytes than
+// limits allow is rejected as TOO_LARGE once the limit is crossed; what was
+// extracted up to then is left in place.
+func (s *FileService) ExtractArchive(src io.Reader, size int64, name, dir, format string, limits ExtractLimits) (*model.ExtractResponse, error) {
+	dest, err := s.policy.resolve(s.uploadDir(dir))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.policy.mkdirAll(dest); err != nil {
+		return nil, classifyFSError(err)
+	}
+
+	br := bufio.NewReaderSize(src, 4096)
+	if format == "" {
+		head, _ := br.Peek(512)
+		format = detectArchiveFormat(head, name)
+	}
+
+	x := &extractor{policy: s.policy, dest: dest, limits: limits, dirModes: make(map[string]os.FileMode), links: make(map[string]bool)}
+	switch format {
+	case ArchiveTar:
+		err = x.extractTar(br)
+	case ArchiveTarGz, "tgz":
+		format = ArchiveTarGz
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(br); err == nil {
+			err = x.extractTar(gz)
+			gz.Close()
+		}
+	case ArchiveZip:
+		err = x.extractZip(src, br, size)
+	case "":
+		return nil, newError(CodeInvalidArchive, "unrecognized archive format; set format to tar, tar.gz or zip")
+	default:
+		return nil, newError(CodeInvalidRequest, "unsupported archive format: %s", format)
+	}
+	if err == nil {
+		err = x.finish()
+	}
+	if err != nil {
+		return nil, classifyArchiveError(err)
+	}
+
+	return &model.ExtractResponse{
+		Status: "success",
+		Path:   dest,
+		Format: format,
+		Files:  x.files,
+		Bytes:  x.bytes,
+	}, nil
+}
+
+// detectArchiveFormat guesses the format from the leading bytes of the
+// archive, falling back to the file name extension
+func detectArchiveFormat(head []byte, name string) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return ArchiveTarGz
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return ArchiveZip
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return ArchiveTar
+	}
+
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return ArchiveTarGz
+	case strings.HasSuffix(name, ".tar"):
+		return ArchiveTar
+	case strings.HasSuffix(name, ".zip"):
+		return ArchiveZip
+	}
+	return ""
+}
+
+// classifyArchiveError reports corrupt archives as INVALID_ARCHIVE
+func classifyArchiveError(err error) error {
+	switch {
+	case errors.Is(err, tar.ErrHeader), errors.Is(err, zip.ErrFormat), errors.Is(err, gzip.ErrHeader),
+		errors.Is(err, gzip.ErrChecksum), errors.Is(err, io.ErrUnexpectedEOF):
+		return newError(CodeInvalidArchive, "invalid archive: %v", err)
+	}
+	return classifyFSError(err)
+}
+
+// extractor writes archive entries below a destination directory
+type extractor struct {
+	policy   *PathPolicy
+	dest     string
+	limits   ExtractLimits
+	entries  int
+	files    int
+	bytes    int64
+	dirModes map[string]os.FileMode // 目录在解压结束后才设置权限，以免只读目录阻止写入
+	links    map[string]bool        // 本次解压创建的符号链接，其下的条目一律拒绝
+}
+
+func (x *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := x.countEntry(); err != nil {
+			return err
+		}
+
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = x.dir(hdr.Name, mode)
+		case tar.TypeReg, tar.TypeRegA:
+			err = x.file(hdr.Name, tr, mode, hdr.ModTime)
+		case tar.TypeSymlink:
+			err = x.symlink(hdr.Name, hdr.Linkname)
+		case tar.TypeLink:
+			err = x.link(hdr.Name, hdr.Linkname)
+		default:
+			// 设备文件、FIFO 以及 PAX 扩展头之外的特殊条目不解压
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) extractZip(src io.Reader, br *bufio.Reader, size int64) error {
+	ra, ok := src.(io.ReaderAt)
+	if !ok || size < 0 {
+		// zip 的目录位于文件末尾，需要随机访问，先写入临时文件
+		tmp, err := os.CreateTemp(x.limits.StagingDir, "litterbox-upload-*.zip")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		if size, err = io.Copy(tmp, br); err != nil {
+			return err
+		}
+		ra = tmp
+	}
+
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		if err := x.countEntry(); err != nil {
+			return err
+		}
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = x.dir(f.Name, mode)
+		case mode&os.ModeSymlink != 0:
+			err = x.zipSymlink(f)
+		case mode.IsRegular():
+			err = x.zipFile(f)
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) zipFile(f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return x.file(f.Name, rc, f.Mode(), f.Modified)
+}
+
+func (x *extractor) zipSymlink(f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	target, err := io.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return err
+	}
+	return x.symlink(f.Name, string(target))
+}
+
+// countEntry counts an archive entry against the entry limit
+func (x *extractor) countEntry() error {
+	x.entries++
+	if x.limits.MaxEntries > 0 && x.entries > x.limits.MaxEntries {
+		return newError(CodeTooLarge, "archive has more than %d entries", x.limits.MaxEntries)
+	}
+	return nil
+}
+
+// target returns the path an entry is extracted to. The entry name must stay
+// inside the destination, and so must its parent directory once symlinks
+// are resolved. Entries below a symlink created by an earlier entry are
+// rejected outright, whatever the link points to.
+func (x *extractor) target(name string) (string, error) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	rel := path.Clean(name)
+	if path.IsAbs(name) || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", newError(CodeInvalidArchive, "archive entry escapes the destination: %s", name)
+	}
+	if rel == "." {
+		return x.dest, nil
+	}
+
+	full := filepath.Join(x.dest, filepath.FromSlash(rel))
+	for dir := filepath.Dir(full); dir != x.dest; dir = filepath.Dir(dir) {
+		if x.links[dir] {
+			return "", newError(CodeInvalidArchive, "archive entry is inside a symlink from the same archive: %s", name)
+		}
+	}
+	parent, err := x.policy.canonical(filepath.Dir(full))
+	if err != nil {
+		return "", err
+	}
+	if !within(parent, x.dest) {
+		return "", newError(CodeInvalidArchive, "archive entry escapes the destination through a symlink: %s", name)
+	}
+
+	full = filepath.Join(parent, filepath.Base(full))
+	if err := x.policy.check(full, full); err != nil {
+		return "", err
+	}
+	return full, nil
+}
+
+// prepare creates the parent directories of an entry and removes a file or
+// symlink that is in its way, so that it is replaced rather than followed
+func (x *extractor) prepare(target string) error {
+	if err := x.policy.mkdirAll(filepath.Dir(target)); err != nil {
+		return err
+	}
+
+	return x.policy.at(target, func(at string) error {
+		info, err := os.Lstat(at)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return newError(CodeIsDirectory, "cannot replace directory %s with a file", target)
+		}
+		delete(x.links, target)
+		return os.Remove(at)
+	})
+}
+
+func (x *extractor) dir(name string, mode os.FileMode) error {
+	target, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if err := x.policy.mkdirAll(target); err != nil {
+		return err
+	}
+	if target != x.dest {
+		x.dirModes[target] = mode.Perm()
+	}
+	return nil
+}
+
+func (x *extractor) file(name string, r io.Reader, mode os.FileMode, mtime time.Time) error {
+	target, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if err := x.prepare(target); err != nil {
+		return err
+	}
+
+	// 不保留 setuid/setgid 位
+	perm := mode.Perm()
+	out, err := x.policy.openFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if x.limits.MaxBytes > 0 {
+		// 多读一个字节以判断是否超出限制，压缩包中记录的大小不可信
+		r = io.LimitReader(r, x.limits.MaxBytes-x.bytes+1)
+	}
+	n, err := io.Copy(out, r)
+	x.bytes += n
+	if err == nil && x.limits.MaxBytes > 0 && x.bytes > x.limits.MaxBytes {
+		err = newError(CodeTooLarge, "archive expands to more than %d bytes", x.limits.MaxBytes)
+	}
+	if err == nil {
+		err = out.Chmod(perm)
+	}
+	if err == nil && !mtime.IsZero() {
+		tv := syscall.NsecToTimeval(mtime.UnixNano())
+		syscall.Futimes(int(out.Fd()), []syscall.Timeval{tv, tv})
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	x.files++
+	return nil
+}
+
+// symlink creates a symlink as stored in the archive. The link target is not
+// restricted, since later entries are never written through it and reads
+// through it are checked by the path policy.
+func (x *extractor) symlink(name, linkname string) error {
+	target, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if err := x.prepare(target); err != nil {
+		return err
+	}
+	err = x.policy.at(target, func(at string) error {
+		return os.Symlink(linkname, at)
+	})
+	if err != nil {
+		return err
+	}
+	x.links[target] = true
+	x.files++
+	return nil
+}
+
+// link creates a hard link to an entry extracted earlier
+func (x *extractor) link(name, linkname string) error {
+	source, err := x.target(linkname)
+	if err != nil {
+		return err
+	}
+	target, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if err := x.prepare(target); err != nil {
+		return err
+	}
+	err = x.policy.at(source, func(sourceAt string) error {
+		return x.policy.at(target, func(targetAt string) error {
+			return os.Link(sourceAt, targetAt)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("hard link %s to %s: %w", name, linkname, err)
+	}
+	x.files++
+	return nil
+}
+
+// finish applies the modes of the extracted directories, deepest first
+func (x *extractor) finish() error {
+	dirs := make([]string, 0, len(x.dirModes))
+	for dir := range x.dirModes {
+		dirs = append(dirs, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+
+	for _, dir := range dirs {
+		if err := x.policy.chmod(dir, x.dirModes[dir]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StreamArchive writes the directory or file at path to w as a tar.gz or zip
+// archive, without creating a temporary file. Entries are named relative to
+// the parent of path, so that the archive unpacks into a directory of the
+// same name. Only files matching an include glob are archived when include
+// is set; entries matching an exclude glob are skipped. Files that cannot be
+// read are left out. started is called with the suggested file name of the
+// archive once the request has been validated, before anything is written.
+func (s *FileService) StreamArchive(path, format string, include, exclude []string, started func(filename string), w io.Writer) error {
+	root, err := s.policy.resolve(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return classifyFSError(err)
+	}
+
+	base := filepath.Base(root)
+	if root == "/" {
+		base = "root"
+	}
+
+	var archive archiveWriter
+	switch format {
+	case "", ArchiveTarGz, "tgz":
+		started(base + ".tar.gz")
+		archive = newTarGzArchive(w, s.policy)
+	case ArchiveZip:
+		started(base + ".zip")
+		archive = newZipArchive(w, s.policy)
+	default:
+		return newError(CodeInvalidRequest, "unsupported archive format: %s (expected tar.gz or zip)", format)
+	}
+
+	parent := filepath.Dir(root)
+	add := func(path string, info os.FileInfo) error {
+		name, err := filepath.Rel(parent, path)
+		if err != nil {
+			return err
+		}
+		return archive.add(filepath.ToSlash(name), path, info)
+	}
+
+	if !info.IsDir() {
+		if err := add(root, info); err != nil {
+			return err
+		}
+		return archive.Close()
+	}
+
+	if len(include) == 0 {
+		if err := add(root, info); err != nil {
+			return err
+		}
+	}
+	filter := globFilter{root: root, include: include, exclude: exclude}
+	opts := walkOptions{showHidden: true}
+	err = s.policy.walk(root, opts, func(path string, info os.FileInfo, depth int) error {
+		if s.policy.check(path, path) != nil || filter.excluded(path) {
+			return filepath.SkipDir
+		}
+		// 指定了 include 时只打包匹配的文件，目录由文件路径隐含
+		if info.IsDir() && len(include) > 0 {
+			return nil
+		}
+		if !filter.included(path) {
+			return nil
+		}
+		return add(path, info)
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// archiveWriter writes entries of a streamed archive
+type archiveWriter interface {
+	// add writes the file at path under name; unreadable files are skipped
+	add(name, path string, info os.FileInfo) error
+	Close() error
+}
+
+type tarGzArchive struct {
+	gz     *gzip.Writer
+	tw     *tar.Writer
+	policy *PathPolicy
+}
+
+func newTarGzArchive(w io.Writer, policy *PathPolicy) *tarGzArchive {
+	gz := gzip.NewWriter(w)
+	return &tarGzArchive{gz: gz, tw: tar.NewWriter(gz), policy: policy}
+}
+
+func (a *tarGzArchive) add(name, path string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return nil
+		}
+	}
+
+	var file *os.File
+	if info.Mode().IsRegular() {
+		var err error
+		if file, err = a.policy.openFile(path, os.O_RDONLY, 0); err != nil {
+			return nil
+		}
+		defer file.Close()
+		// 以打开后的大小为准
+		if info, err = file.Stat(); err != nil {
+			return nil
+		}
+	} else if !info.IsDir() && link == "" {
+		// 设备文件、socket 等不打包
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	// 不包含本机的用户名和组名
+	hdr.Uname, hdr.Gname = "", ""
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if file != nil {
+		if _, err := io.CopyN(a.tw, file, hdr.Size); err != nil {
+			return fmt.Errorf("%s changed while being archived: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (a *tarGzArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+type zipArchive struct {
+	zw     *zip.Writer
+	policy *PathPolicy
+}
+
+func newZipArchive(w io.Writer, policy *PathPolicy) *zipArchive {
+	return &zipArchive{zw: zip.NewWriter(w), policy: policy}
+}
+
+func (a *zipArchive) add(name, path string, info os.FileInfo) error {
+	var content io.Reader
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		// zip 中的符号链接以链接目标作为内容
+		link, err := os.Readlink(path)
+		if err != nil {
+			return nil
+		}
+		content = strings.NewReader(link)
+	case info.Mode().IsRegular():
+		file, err := a.policy.openFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			return nil
+		}
+		defer file.Close()
+		content = file
+	case !info.IsDir():
+		return nil
+	}
+
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	} else if info.Mode().IsRegular() {
+		hdr.Method = zip.Deflate
+	}
+
+	out, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	if content != nil {
+		if _, err := io.Copy(out, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
@@ -0,0 +1,274 @@
+package service
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"litterbox-agent/internal/config"
+)
+
+func TestExtractArchiveRejectsEntriesThroughArchiveSymlinks(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	outside := filepath.Join(dir, "outside")
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	victim := filepath.Join(outside, "victim")
+	if err := os.WriteFile(victim, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 工作区包含 outside，只有解压目标的检查能阻止写入
+	policy, err := NewPathPolicy(config.WorkspaceConfig{Root: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewFileService(policy)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "b", Typeflag: tar.TypeSymlink, Linkname: outside},
+		{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "nonexist/../b"},
+		{Name: "a/victim", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len("pwned"))},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte("pwned"))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ExtractArchive(&buf, int64(buf.Len()), "evil.tar", dest, ArchiveTar, ExtractLimits{}); err == nil {
+		t.Error("ExtractArchive succeeded, want an error")
+	}
+
+	content, err := os.ReadFile(victim)
+	if err != nil {
+		t.Fatalf("file outside the destination was removed: %v", err)
+	}
+	if string(content) != "original" {
+		t.Errorf("file outside the destination was overwritten with %q", content)
+	}
+}
+
+func TestExtractArchiveRejectsEntriesBelowArchiveSymlinks(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err := os.MkdirAll(filepath.Join(dest, "real"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := NewPathPolicy(config.WorkspaceConfig{Root: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewFileService(policy)
+
+	// 即使链接指向解压目标之内，也不通过它写入
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "real"})
+	tw.WriteHeader(&tar.Header{Name: "link/file", Typeflag: tar.TypeReg, Mode: 0644})
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ExtractArchive(&buf, int64(buf.Len()), "", dest, ArchiveTar, ExtractLimits{}); err == nil {
+		t.Error("ExtractArchive succeeded, want an error")
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "real", "file")); err == nil {
+		t.Error("entry was written through a symlink from the archive")
+	}
+}
+
+func TestExtractArchiveLimits(t *testing.T) {
+	// zip 以不支持 io.ReaderAt 的 reader 传入，需要先写入暂存目录
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(bytes.Repeat([]byte("x"), 100))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		limits  ExtractLimits
+		wantErr string
+	}{
+		{"within limits", ExtractLimits{MaxBytes: 300, MaxEntries: 3}, ""},
+		{"too many entries", ExtractLimits{MaxEntries: 2}, CodeTooLarge},
+		{"too many bytes", ExtractLimits{MaxBytes: 250}, CodeTooLarge},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, dir := newTestFileService(t)
+			staging := t.TempDir()
+			tt.limits.StagingDir = staging
+
+			src := io.MultiReader(bytes.NewReader(zipped.Bytes()))
+			resp, err := s.ExtractArchive(src, -1, "files.zip", filepath.Join(dir, "dest"), ArchiveZip, tt.limits)
+			var coded *Error
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr == "" && (resp.Files != 3 || resp.Bytes != 300):
+				t.Errorf("extracted %d files, %d bytes; want 3 files, 300 bytes", resp.Files, resp.Bytes)
+			case tt.wantErr != "" && (!errors.As(err, &coded) || coded.Code != tt.wantErr):
+				t.Errorf("error = %v, want %s", err, tt.wantErr)
+			}
+
+			if spooled, _ := os.ReadDir(staging); len(spooled) != 0 {
+				t.Errorf("spooled archive left in the staging directory: %v", spooled)
+			}
+		})
+	}
+}
+
+func TestStreamArchive(t *testing.T) {
+	s, dir := newTestFileService(t)
+	root := filepath.Join(dir, "proj")
+	files := map[string]string{
+		"a.txt":      "alpha",
+		".env":       "secret",
+		"sub/b.go":   "package sub",
+		"skip/c.txt": "gamma",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    string
+	}{
+		{"everything", nil, nil, "proj/,proj/.env,proj/a.txt,proj/skip/,proj/skip/c.txt,proj/sub/,proj/sub/b.go"},
+		{"include", []string{"*.go", "skip/*"}, nil, "proj/skip/c.txt,proj/sub/b.go"},
+		{"exclude", nil, []string{"skip", ".*"}, "proj/,proj/a.txt,proj/sub/,proj/sub/b.go"},
+	}
+	for _, format := range []string{ArchiveTarGz, ArchiveZip} {
+		for _, tt := range tests {
+			t.Run(format+"/"+tt.name, func(t *testing.T) {
+				var buf bytes.Buffer
+				filename := ""
+				err := s.StreamArchive(root, format, tt.include, tt.exclude, func(name string) { filename = name }, &buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := "proj." + format; filename != want {
+					t.Errorf("filename = %q, want %q", filename, want)
+				}
+
+				names, contents := readTestArchive(t, format, buf.Bytes())
+				if got := strings.Join(names, ","); got != tt.want {
+					t.Errorf("entries = %q, want %q", got, tt.want)
+				}
+				for _, name := range names {
+					if strings.HasSuffix(name, "/") {
+						continue
+					}
+					if want := files[strings.TrimPrefix(name, "proj/")]; contents[name] != want {
+						t.Errorf("%s content = %q, want %q", name, contents[name], want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestStreamArchiveRejectsUnknownFormat(t *testing.T) {
+	s, dir := newTestFileService(t)
+
+	err := s.StreamArchive(dir, "rar", nil, nil, func(string) {}, io.Discard)
+	var coded *Error
+	if !errors.As(err, &coded) || coded.Code != CodeInvalidRequest {
+		t.Errorf("error = %v, want %s", err, CodeInvalidRequest)
+	}
+}
+
+// readTestArchive returns the entry names of a streamed archive in order and
+// the contents of its regular files
+func readTestArchive(t *testing.T, format string, data []byte) ([]string, map[string]string) {
+	t.Helper()
+	var names []string
+	contents := map[string]string{}
+
+	switch format {
+	case ArchiveTarGz:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, hdr.Name)
+			if hdr.Typeflag == tar.TypeReg {
+				content, err := io.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				contents[hdr.Name] = string(content)
+			}
+		}
+	case ArchiveZip:
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+			if f.Mode().IsRegular() {
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				content, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				contents[f.Name] = string(content)
+			}
+		}
+	}
+	return names, contents
+}
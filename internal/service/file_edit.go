@@ -0,0 +1,190 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"litterbox-agent/internal/model"
+)
+
+// multiEdit applies a list of str_replace and insert edits to a file in
+// order, each seeing the result of the previous ones. The edits are applied
+// in memory and the file is written only if all of them succeed, so a failed
+// batch leaves the file untouched and a successful one is a single undo_edit
+// step.
+func (s *FileService) multiEdit(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
+	data, err := s.policy.readFile(req.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkETag(req.Path, req.IfMatch, data); err != nil {
+		return nil, err
+	}
+	content := string(data)
+	eol := lineEnding(content)
+
+	newContent := content
+	for i, edit := range req.Edits {
+		var failure string
+		var lines []int
+
+		switch edit.Command {
+		case "str_replace":
+			if failure = validateReplace(edit.OldStr, edit.ReplaceAll, edit.Occurrence); failure != "" {
+				break
+			}
+			result := replaceString(newContent, withLineEnding(edit.OldStr, eol), withLineEnding(edit.NewStr, eol), edit.ReplaceAll, edit.Occurrence)
+			newContent, failure, lines = result.content, result.failure, result.lines
+		case "insert":
+			if edit.NewStr == "" {
+				failure = "new_str required for insert"
+				break
+			}
+			newContent, failure = insertText(newContent, edit.InsertLine, edit.NewStr)
+		default:
+			failure = fmt.Sprintf("unsupported command %q (expected str_replace or insert)", edit.Command)
+		}
+
+		if failure != "" {
+			index := i
+			return &model.FileOperationResponse{
+				Success:    false,
+				Message:    fmt.Sprintf("edit %d (%s) failed: %s; no changes were written", i, edit.Command, failure),
+				MatchLines: lines,
+				FailedEdit: &index,
+			}, nil
+		}
+	}
+
+	if err := s.writeFileAtomic(req.Path, []byte(newContent)); err != nil {
+		return nil, err
+	}
+	s.addHistory(req.Path, content)
+
+	return &model.FileOperationResponse{
+		Success: true,
+		Message: fmt.Sprintf("Applied %d edits", len(req.Edits)),
+		ETag:    contentETag([]byte(newContent)),
+	}, nil
+}
+
+// validateReplace checks the arguments of a str_replace edit, returning the
+// reason they are invalid
+func validateReplace(oldStr string, replaceAll bool, occurrence int) string {
+	switch {
+	case oldStr == "":
+		return "old_str required for str_replace"
+	case occurrence < 0:
+		return "occurrence must be positive"
+	case replaceAll && occurrence > 0:
+		return "replace_all and occurrence cannot be combined"
+	}
+	return ""
+}
+
+// replaceResult is the outcome of replacing a string in file content
+type replaceResult struct {
+	content string // 替换后的内容
+	count   int    // 替换的处数
+	line    int    // 只替换一处时所在的行号
+	lines   []int  // 所有匹配所在的行号
+	failure string // 无法替换的原因，为空表示成功
+}
+
+// replaceString replaces oldStr in content. By default oldStr must occur
+// exactly once, so that an ambiguous edit fails instead of changing more than
+// intended; replaceAll replaces every occurrence and occurrence (starting at
+// 1) selects a single one.
+func replaceString(content, oldStr, newStr string, replaceAll bool, occurrence int) replaceResult {
+	if oldStr == "" {
+		// 空字符串在每个位置都匹配
+		return replaceResult{failure: "old_str must not be empty"}
+	}
+
+	var offsets []int
+	for i := 0; ; {
+		j := strings.Index(content[i:], oldStr)
+		if j < 0 {
+			break
+		}
+		offsets = append(offsets, i+j)
+		i += j + len(oldStr)
+	}
+
+	result := replaceResult{lines: make([]int, len(offsets))}
+	line, last := 1, 0
+	for k, offset := range offsets {
+		line += strings.Count(content[last:offset], "\n")
+		last = offset
+		result.lines[k] = line
+	}
+
+	switch {
+	case len(offsets) == 0:
+		result.failure = "String not found in file"
+		return result
+	case replaceAll:
+		result.content = strings.ReplaceAll(content, oldStr, newStr)
+		result.count = len(offsets)
+		return result
+	case occurrence > len(offsets):
+		result.failure = fmt.Sprintf("occurrence %d requested, but old_str matches %s", occurrence, describeMatches(result.lines))
+		return result
+	case occurrence == 0 && len(offsets) > 1:
+		result.failure = fmt.Sprintf("old_str matches %s; include more surrounding context to make it unique, or set replace_all or occurrence", describeMatches(result.lines))
+		return result
+	}
+
+	k := max(occurrence-1, 0)
+	result.content = content[:offsets[k]] + newStr + content[offsets[k]+len(oldStr):]
+	result.count = 1
+	result.line = result.lines[k]
+	return result
+}
+
+// describeMatches formats a match count with the line numbers of the matches
+func describeMatches(lines []int) string {
+	numbers := make([]string, len(lines))
+	for i, line := range lines {
+		numbers[i] = fmt.Sprint(line)
+	}
+	if len(lines) == 1 {
+		return fmt.Sprintf("once (line %s)", numbers[0])
+	}
+	return fmt.Sprintf("%d times (lines %s)", len(lines), strings.Join(numbers, ", "))
+}
+
+// insertText inserts text as a new line after line n of content (0 inserts
+// at the beginning), converting it to the line ending of content. Whether
+// content ends with a newline is kept. It returns the new content, or the
+// reason the text cannot be inserted.
+func insertText(content string, n int, text string) (string, string) {
+	// 每行保留各自的换行符，最后一行可能没有换行符
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if n < 0 || n > len(lines) {
+		return "", fmt.Sprintf("Invalid line number: %d (file has %d lines)", n, len(lines))
+	}
+
+	eol := lineEnding(content)
+	text = withLineEnding(text, eol)
+
+	newLines := make([]string, 0, len(lines)+1)
+	newLines = append(newLines, lines[:n]...)
+	if n == len(lines) && (len(lines) == 0 || !strings.HasSuffix(lines[len(lines)-1], "\n")) {
+		// 插入到没有换行符的最后一行之后，文件末尾仍然没有换行符
+		if len(newLines) > 0 {
+			newLines[len(newLines)-1] += eol
+		}
+		newLines = append(newLines, text)
+	} else {
+		newLines = append(newLines, text+eol)
+	}
+	newLines = append(newLines, lines[n:]...)
+
+	return strings.Join(newLines, ""), ""
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"litterbox-agent/internal/model"
+)
+
+func TestMultiEditAppliesInOrder(t *testing.T) {
+	s, dir := newTestFileService(t)
+	path := filepath.Join(dir, "file.txt")
+	writeTestFile(t, path, []string{"one", "two", "three"})
+
+	mustOperate(t, s, &model.FileOperationRequest{
+		Command: "multi_edit",
+		Path:    path,
+		Edits: []model.FileEdit{
+			{Command: "str_replace", OldStr: "two", NewStr: "zwei"},
+			// 第二个编辑看到的是第一个编辑的结果
+			{Command: "str_replace", OldStr: "zwei", NewStr: "deux"},
+			{Command: "insert", InsertLine: 0, NewStr: "zero"},
+		},
+	})
+	if got := strings.Join(readTestLines(t, path), ","); got != "zero,one,deux,three" {
+		t.Errorf("file = %q, want %q", got, "zero,one,deux,three")
+	}
+
+	// 整个批次是一次 undo
+	mustOperate(t, s, &model.FileOperationRequest{Command: "undo_edit", Path: path})
+	if got := strings.Join(readTestLines(t, path), ","); got != "one,two,three" {
+		t.Errorf("file after undo = %q, want %q", got, "one,two,three")
+	}
+}
+
+func TestMultiEditAllOrNothing(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		edits  []model.FileEdit
+		failed int
+	}{
+		{
+			name: "missing match",
+			edits: []model.FileEdit{
+				{Command: "str_replace", OldStr: "one", NewStr: "uno"},
+				{Command: "str_replace", OldStr: "four", NewStr: "quatre"},
+			},
+			failed: 1,
+		},
+		{
+			name: "ambiguous match",
+			edits: []model.FileEdit{
+				{Command: "insert", InsertLine: 3, NewStr: "one"},
+				{Command: "str_replace", OldStr: "two", NewStr: "dos"},
+				{Command: "str_replace", OldStr: "one", NewStr: "uno"},
+			},
+			failed: 2,
+		},
+		{
+			name: "match removed by an earlier edit",
+			edits: []model.FileEdit{
+				{Command: "str_replace", OldStr: "two", NewStr: "zwei"},
+				{Command: "str_replace", OldStr: "two", NewStr: "deux"},
+			},
+			failed: 1,
+		},
+		{
+			name: "line out of range",
+			edits: []model.FileEdit{
+				{Command: "str_replace", OldStr: "three", NewStr: "drei"},
+				{Command: "insert", InsertLine: 10, NewStr: "ten"},
+			},
+			failed: 1,
+		},
+		{
+			name: "unsupported command",
+			edits: []model.FileEdit{
+				{Command: "create", NewStr: "x"},
+			},
+			failed: 0,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, dir := newTestFileService(t)
+			path := filepath.Join(dir, "file.txt")
+			writeTestFile(t, path, []string{"one", "two", "three"})
+
+			resp, err := s.FileOperation(&model.FileOperationRequest{Command: "multi_edit", Path: path, Edits: tt.edits})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Success || resp.FailedEdit == nil || *resp.FailedEdit != tt.failed {
+				t.Errorf("response %+v, want edit %d reported as failed", resp, tt.failed)
+			}
+			if got := strings.Join(readTestLines(t, path), ","); got != "one,two,three" {
+				t.Errorf("file = %q, want it untouched", got)
+			}
+
+			resp, err = s.FileOperation(&model.FileOperationRequest{Command: "undo_edit", Path: path})
+			if err != nil || resp.Success {
+				t.Errorf("undo_edit = %+v, %v; want no history", resp, err)
+			}
+		})
+	}
+}
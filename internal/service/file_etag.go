@@ -0,0 +1,43 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+)
+
+// etagOf formats the version token of file content from a SHA-256 of it.
+// /download sends the same token, quoted, as its ETag header.
+func etagOf(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// contentETag returns the version token of content
+func contentETag(content []byte) string {
+	h := sha256.New()
+	h.Write(content)
+	return etagOf(h)
+}
+
+// ETag returns the version token of the content read from r
+func ETag(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return etagOf(h), nil
+}
+
+// checkETag fails with CONFLICT when ifMatch is set and is not the version
+// token of content. ifMatch may be quoted like an HTTP entity tag.
+func checkETag(path, ifMatch string, content []byte) error {
+	if ifMatch == "" {
+		return nil
+	}
+	if etag := contentETag(content); strings.Trim(ifMatch, `"`) != etag {
+		return newError(CodeConflict, "%s has changed (etag is %s, expected %s); view it again before editing", path, etag, ifMatch)
+	}
+	return nil
+}
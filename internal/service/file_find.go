@@ -0,0 +1,93 @@
+package service
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"litterbox-agent/internal/model"
+)
+
+// findFiles returns the entries below a directory that match the pattern
+// glob, the include and exclude globs and the type, size and modification
+// time filters of the request, in the same order as list. An entry has to
+// pass all of them.
+func (s *FileService) findFiles(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
+	switch req.Type {
+	case "", "file", "dir", "symlink", "other":
+	default:
+		return nil, newError(CodeInvalidRequest, "invalid type: %s (expected file, dir, symlink or other)", req.Type)
+	}
+
+	maxResults := req.MaxResults
+	if maxResults <= 0 {
+		maxResults = defaultSearchResults
+	}
+	if maxResults > maxSearchResults {
+		maxResults = maxSearchResults
+	}
+
+	filter := globFilter{root: req.Path, include: req.Include, exclude: req.Exclude}
+
+	opts := walkOptions{
+		maxDepth:         req.MaxDepth,
+		showHidden:       req.ShowHidden,
+		respectGitignore: req.RespectGitignore,
+	}
+
+	entries := []*model.FileEntry{}
+	truncated := false
+	err := s.policy.walk(req.Path, opts, func(path string, info os.FileInfo, depth int) error {
+		if s.policy.check(path, path) != nil || filter.excluded(path) {
+			return filepath.SkipDir
+		}
+		if req.Pattern != "" && !filter.match(req.Pattern, path) {
+			return nil
+		}
+		if !filter.included(path) || !matchesFind(req, info) {
+			return nil
+		}
+		if len(entries) >= maxResults {
+			truncated = true
+			return fs.SkipAll
+		}
+		entries = append(entries, fileEntry(req.Path, path, info))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	message := fmt.Sprintf("%d entries found in %s", len(entries), req.Path)
+	if truncated {
+		message += fmt.Sprintf(" (stopped at %d results)", maxResults)
+	}
+	return &model.FileOperationResponse{
+		Success:   true,
+		Message:   message,
+		Entries:   entries,
+		Truncated: truncated,
+	}, nil
+}
+
+// matchesFind reports whether an entry passes the type, size and
+// modification time filters of a find request
+func matchesFind(req *model.FileOperationRequest, info os.FileInfo) bool {
+	if req.Type != "" && fileType(info.Mode()) != req.Type {
+		return false
+	}
+	if req.MinSize > 0 && info.Size() < req.MinSize {
+		return false
+	}
+	if req.MaxSize > 0 && info.Size() > req.MaxSize {
+		return false
+	}
+	if req.ModifiedAfter != nil && !info.ModTime().After(*req.ModifiedAfter) {
+		return false
+	}
+	if req.ModifiedBefore != nil && !info.ModTime().Before(*req.ModifiedBefore) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"litterbox-agent/internal/model"
+)
+
+// writeTestTree creates empty files at the given slash-separated paths below dir
+func writeTestTree(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// entryNames returns the names of the entries of a list or find response
+func entryNames(resp *model.FileOperationResponse) string {
+	names := make([]string, len(resp.Entries))
+	for i, entry := range resp.Entries {
+		names[i] = entry.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func TestFindCombinesPatternWithFilters(t *testing.T) {
+	s, dir := newTestFileService(t)
+	writeTestTree(t, dir,
+		"main.go",
+		"docs/guide.md",
+		"docs/gen/api.go",
+		"docs/gen/api_test.go",
+		"src/util.go",
+	)
+
+	for _, tt := range []struct {
+		name    string
+		req     model.FileOperationRequest
+		entries string
+	}{
+		{
+			name:    "pattern only",
+			req:     model.FileOperationRequest{Pattern: "*.go"},
+			entries: "docs/gen/api.go,docs/gen/api_test.go,main.go,src/util.go",
+		},
+		{
+			name:    "pattern and include",
+			req:     model.FileOperationRequest{Pattern: "*.go", Include: []string{"docs/**"}},
+			entries: "docs/gen/api.go,docs/gen/api_test.go",
+		},
+		{
+			name:    "pattern, include and exclude",
+			req:     model.FileOperationRequest{Pattern: "*.go", Include: []string{"docs/**"}, Exclude: []string{"*_test.go"}},
+			entries: "docs/gen/api.go",
+		},
+		{
+			name:    "pattern with a slash",
+			req:     model.FileOperationRequest{Pattern: "src/*", Type: "file"},
+			entries: "src/util.go",
+		},
+		{
+			name:    "include only",
+			req:     model.FileOperationRequest{Include: []string{"*.md"}},
+			entries: "docs/guide.md",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			req.Command, req.Path = "find", dir
+			resp, err := s.FileOperation(&req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := entryNames(resp); got != tt.entries {
+				t.Errorf("entries = %s, want %s", got, tt.entries)
+			}
+		})
+	}
+}
+
+func TestFindTruncation(t *testing.T) {
+	s, dir := newTestFileService(t)
+	writeTestTree(t, dir, "a.txt", "b.txt", "c.txt")
+
+	for _, tt := range []struct {
+		maxResults int
+		entries    string
+		truncated  bool
+	}{
+		{maxResults: 2, entries: "a.txt,b.txt", truncated: true},
+		{maxResults: 3, entries: "a.txt,b.txt,c.txt", truncated: false},
+	} {
+		resp, err := s.FileOperation(&model.FileOperationRequest{Command: "find", Path: dir, Pattern: "*.txt", MaxResults: tt.maxResults})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := entryNames(resp); got != tt.entries || resp.Truncated != tt.truncated {
+			t.Errorf("max_results %d: entries %s, truncated %v; want %s, %v", tt.maxResults, got, resp.Truncated, tt.entries, tt.truncated)
+		}
+	}
+}
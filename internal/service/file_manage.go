@@ -0,0 +1,411 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+
+	"github.com/google/uuid"
+
+	"litterbox-agent/internal/model"
+)
+
+// statFile returns the entry of a single file. A symlink is described
+// itself, not its target.
+func (s *FileService) statFile(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
+	path, err := s.policy.resolveNoFollow(req.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := s.lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.FileOperationResponse{
+		Success: true,
+		Message: fmt.Sprintf("%s is a %s", path, fileType(info.Mode())),
+		Entry:   fileEntry(filepath.Dir(path), path, info),
+	}, nil
+}
+
+// deleteFile removes a file, a symlink or an empty directory; non-empty
+// directories are only removed when recursive is set
+func (s *FileService) deleteFile(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
+	path, err := s.resolveTree(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	if path == s.policy.Root() || path == "/" {
+		return nil, newError(CodeInvalidRequest, "refusing to delete %s", path)
+	}
+
+	info, err := s.lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() && req.Recursive {
+		err = s.policy.at(path, os.RemoveAll)
+	} else {
+		err = s.policy.at(path, os.Remove)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.FileOperationResponse{
+		Success: true,
+		Message: fmt.Sprintf("Deleted %s", path),
+	}, nil
+}
+
+// moveFile renames a file or directory, copying it when the destination is
+// on another file system. An existing destination replaced with overwrite is
+// only removed once the source is in its place.
+func (s *FileService) moveFile(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
+	src, err := s.resolveTree(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := s.policy.resolveNoFollow(req.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.lstat(src); err != nil {
+		return nil, err
+	}
+	if within(dst, src) {
+		return nil, newError(CodeInvalidRequest, "cannot move %s into itself", src)
+	}
+	if err := s.prepareDestination(dst, req.Overwrite); err != nil {
+		return nil, err
+	}
+
+	if err := s.replaceDestination(src, dst); err != nil {
+		if !errors.Is(err, syscall.EXDEV) {
+			return nil, err
+		}
+		// 跨文件系统时无法 rename，先复制到目标旁边的临时路径，替换目标后再删除源文件
+		if _, err := s.copyIntoDestination(src, dst); err != nil {
+			return nil, err
+		}
+		if err := s.policy.at(src, os.RemoveAll); err != nil {
+			return nil, err
+		}
+	}
+
+	return &model.FileOperationResponse{
+		Success: true,
+		Message: fmt.Sprintf("Moved %s to %s", src, dst),
+	}, nil
+}
+
+// copyFile copies a file, or a directory tree when recursive is set,
+// preserving permission bits. Symlinks inside the tree are copied as links.
+// The copy is made next to the destination and renamed over it, so a failed
+// copy leaves an existing destination untouched.
+func (s *FileService) copyFile(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
+	src := req.Path
+	if err := s.policy.checkTree(src, src); err != nil {
+		return nil, err
+	}
+	dst, err := s.policy.resolveNoFollow(req.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() && !req.Recursive {
+		return nil, newError(CodeIsDirectory, "%s is a directory; set recursive to copy it", src)
+	}
+	if within(dst, src) {
+		return nil, newError(CodeInvalidRequest, "cannot copy %s into itself", src)
+	}
+	if err := s.prepareDestination(dst, req.Overwrite); err != nil {
+		return nil, err
+	}
+
+	count, err := s.copyIntoDestination(src, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.FileOperationResponse{
+		Success: true,
+		Message: fmt.Sprintf("Copied %s to %s (%d files)", src, dst, count),
+	}, nil
+}
+
+// makeDir creates a directory together with any missing parents, like
+// mkdir -p. An existing directory is not an error. The mode, if given, is
+// applied to the last directory only.
+func (s *FileService) makeDir(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
+	if err := s.policy.mkdirAll(req.Path); err != nil {
+		return nil, err
+	}
+
+	if req.Mode != "" {
+		mode, err := parseFileMode(req.Mode)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.policy.chmod(req.Path, mode); err != nil {
+			return nil, err
+		}
+	}
+
+	return &model.FileOperationResponse{
+		Success: true,
+		Message: fmt.Sprintf("Directory created: %s", req.Path),
+	}, nil
+}
+
+// changeMode sets the permission bits of a file, or of every entry of a
+// directory tree when recursive is set. Symlinks inside the tree are skipped.
+func (s *FileService) changeMode(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
+	mode, err := parseFileMode(req.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	recursive := info.IsDir() && req.Recursive
+	if recursive {
+		if err := s.policy.checkTree(req.Path, req.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.policy.chmod(req.Path, mode); err != nil {
+		return nil, err
+	}
+
+	count := 1
+	if recursive {
+		opts := walkOptions{showHidden: true}
+		err := s.policy.walk(req.Path, opts, func(path string, info os.FileInfo, depth int) error {
+			if info.Mode()&os.ModeSymlink != 0 {
+				return nil
+			}
+			count++
+			return s.policy.chmod(path, mode)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &model.FileOperationResponse{
+		Success: true,
+		Message: fmt.Sprintf("Changed mode of %s to %04o (%d entries)", req.Path, mode, count),
+	}, nil
+}
+
+// resolveTree resolves the source of an operation that acts on a path
+// itself, rejecting it if a denied path lies inside
+func (s *FileService) resolveTree(path string) (string, error) {
+	resolved, err := s.policy.resolveNoFollow(path)
+	if err != nil {
+		return "", err
+	}
+	if err := s.policy.checkTree(path, resolved); err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// prepareDestination makes sure dst can be written: an existing destination
+// is rejected unless overwrite is set, and missing parent directories are
+// created. The destination itself is left in place until it is replaced.
+func (s *FileService) prepareDestination(dst string, overwrite bool) error {
+	if _, err := s.lstat(dst); err == nil {
+		if !overwrite {
+			return newError(CodeAlreadyExists, "destination already exists: %s", dst)
+		}
+		if err := s.policy.checkTree(dst, dst); err != nil {
+			return err
+		}
+	}
+	return s.policy.mkdirAll(filepath.Dir(dst))
+}
+
+// copyIntoDestination copies src to a temporary path next to dst and then
+// replaces dst with it, returning the number of regular files copied. The
+// temporary copy is removed if anything fails.
+func (s *FileService) copyIntoDestination(src, dst string) (int, error) {
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+"."+uuid.New().String()+".tmp")
+	count, err := s.copyTree(src, tmp)
+	if err == nil {
+		err = s.replaceDestination(tmp, dst)
+	}
+	if err != nil {
+		s.policy.at(tmp, os.RemoveAll)
+		return count, err
+	}
+	return count, nil
+}
+
+// replaceDestination renames src to dst, which may exist. A file is replaced
+// atomically by rename; a destination rename cannot replace, such as a
+// directory, is moved aside first and only removed once src is in its place,
+// or moved back if that fails.
+func (s *FileService) replaceDestination(src, dst string) error {
+	err := s.policy.rename(src, dst)
+	if !errors.Is(err, fs.ErrExist) && !errors.Is(err, syscall.ENOTDIR) && !errors.Is(err, syscall.EISDIR) {
+		return err
+	}
+
+	aside := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+"."+uuid.New().String()+".old")
+	if err := s.policy.rename(dst, aside); err != nil {
+		return err
+	}
+	if err := s.policy.rename(src, dst); err != nil {
+		s.policy.rename(aside, dst)
+		return err
+	}
+	s.policy.at(aside, os.RemoveAll)
+	return nil
+}
+
+// lstat returns the Lstat information of a canonical path
+func (s *FileService) lstat(path string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := s.policy.at(path, func(at string) error {
+		var err error
+		info, err = os.Lstat(at)
+		return err
+	})
+	return info, err
+}
+
+// copyTree copies src to dst, recursing into directories, and returns the
+// number of regular files copied. Both trees are walked through directory
+// descriptors, so a symlink swapped in during the copy is copied as a link
+// rather than followed.
+func (s *FileService) copyTree(src, dst string) (int, error) {
+	srcDir, srcName, err := s.policy.openParent(src)
+	if err != nil {
+		return 0, err
+	}
+	defer srcDir.Close()
+	dstDir, dstName, err := s.policy.openParent(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer dstDir.Close()
+
+	count, err := copyTreeAt(srcDir, srcName, dstDir, dstName)
+	err = replaceErrorPath(err, dirPath(srcDir), srcDir.Name())
+	return count, replaceErrorPath(err, dirPath(dstDir), dstDir.Name())
+}
+
+func copyTreeAt(srcDir *os.File, srcName string, dstDir *os.File, dstName string) (int, error) {
+	info, err := os.Lstat(pathAt(srcDir, srcName))
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(pathAt(srcDir, srcName))
+		if err != nil {
+			return 0, err
+		}
+		return 0, os.Symlink(target, pathAt(dstDir, dstName))
+
+	case info.IsDir():
+		// 先以可写权限创建，复制完内容后再设置原权限
+		if err := os.Mkdir(pathAt(dstDir, dstName), 0700); err != nil {
+			return 0, err
+		}
+		in, err := openAt(srcDir, srcName, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err != nil {
+			return 0, err
+		}
+		defer in.Close()
+		out, err := openAt(dstDir, dstName, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err != nil {
+			return 0, err
+		}
+		defer out.Close()
+
+		entries, err := in.ReadDir(-1)
+		if err != nil {
+			return 0, err
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		count := 0
+		for _, entry := range entries {
+			n, err := copyTreeAt(in, entry.Name(), out, entry.Name())
+			count += n
+			if err != nil {
+				err = replaceErrorPath(err, dirPath(in), in.Name())
+				return count, replaceErrorPath(err, dirPath(out), out.Name())
+			}
+		}
+		return count, chmodAt(dstDir, dstName, info.Mode().Perm())
+
+	case info.Mode().IsRegular():
+		return 1, copyRegularFile(srcDir, srcName, dstDir, dstName, info.Mode().Perm())
+
+	default:
+		return 0, newError(CodeInvalidRequest, "cannot copy special file %s", filepath.Join(srcDir.Name(), srcName))
+	}
+}
+
+func copyRegularFile(srcDir *os.File, srcName string, dstDir *os.File, dstName string, perm os.FileMode) error {
+	in, err := openAt(srcDir, srcName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := openAt(dstDir, dstName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Chmod(perm); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// parseFileMode parses an octal permission string such as "755" or "0644"
+func parseFileMode(mode string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || n > 07777 {
+		return 0, newError(CodeInvalidRequest, "invalid mode: %s (expected octal, e.g. 0644)", mode)
+	}
+
+	perm := os.FileMode(n & 0777)
+	if n&04000 != 0 {
+		perm |= os.ModeSetuid
+	}
+	if n&02000 != 0 {
+		perm |= os.ModeSetgid
+	}
+	if n&01000 != 0 {
+		perm |= os.ModeSticky
+	}
+	return perm, nil
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"litterbox-agent/internal/model"
+)
+
+func TestFailedCopyKeepsOverwrittenDestination(t *testing.T) {
+	s, dir := newTestFileService(t)
+
+	// 目录中的 FIFO 无法复制，复制会在中途失败
+	src := filepath.Join(dir, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(src, "a.txt"), []string{"new"})
+	if err := syscall.Mkfifo(filepath.Join(src, "z.fifo"), 0644); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	dst := filepath.Join(dir, "dst")
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(dst, "keep.txt"), []string{"old"})
+
+	_, err := s.FileOperation(&model.FileOperationRequest{
+		Command:     "copy",
+		Path:        src,
+		Destination: dst,
+		Recursive:   true,
+		Overwrite:   true,
+	})
+	if err == nil {
+		t.Fatal("copying a FIFO succeeded")
+	}
+
+	if got := readTestLines(t, filepath.Join(dst, "keep.txt")); got[0] != "old" {
+		t.Errorf("destination content = %q, want it untouched", got)
+	}
+	assertNoTempFiles(t, dir)
+}
+
+func TestMoveOverwritesDestination(t *testing.T) {
+	s, dir := newTestFileService(t)
+
+	tests := []struct {
+		name     string
+		srcIsDir bool
+		dstIsDir bool
+	}{
+		{"file over file", false, false},
+		{"file over directory", false, true},
+		{"directory over file", true, false},
+		{"directory over directory", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := filepath.Join(dir, "src")
+			dst := filepath.Join(dir, "dst")
+			os.RemoveAll(src)
+			os.RemoveAll(dst)
+			for _, f := range []struct {
+				path  string
+				isDir bool
+				line  string
+			}{{src, tt.srcIsDir, "new"}, {dst, tt.dstIsDir, "old"}} {
+				file := f.path
+				if f.isDir {
+					if err := os.Mkdir(f.path, 0755); err != nil {
+						t.Fatal(err)
+					}
+					file = filepath.Join(f.path, "content.txt")
+				}
+				writeTestFile(t, file, []string{f.line})
+			}
+
+			mustOperate(t, s, &model.FileOperationRequest{
+				Command:     "move",
+				Path:        src,
+				Destination: dst,
+				Overwrite:   true,
+			})
+
+			file := dst
+			if tt.srcIsDir {
+				file = filepath.Join(dst, "content.txt")
+			}
+			if got := readTestLines(t, file); got[0] != "new" {
+				t.Errorf("destination content = %q, want the moved content", got)
+			}
+			if _, err := os.Lstat(src); !os.IsNotExist(err) {
+				t.Errorf("source still exists: %v", err)
+			}
+			assertNoTempFiles(t, dir)
+		})
+	}
+}
+
+// assertNoTempFiles fails the test if a temporary copy or a destination
+// moved aside was left in dir
+func assertNoTempFiles(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			t.Errorf("temporary file left behind: %s", entry.Name())
+		}
+	}
+}
+
+func TestListDepth(t *testing.T) {
+	s, dir := newTestFileService(t)
+	writeTestTree(t, dir, "a.txt", ".hidden", "sub/b.txt", "sub/deep/c.txt")
+
+	tests := []struct {
+		name       string
+		maxDepth   int
+		showHidden bool
+		want       string
+	}{
+		{"default depth", 0, false, "a.txt,sub"},
+		{"depth 1", 1, false, "a.txt,sub"},
+		{"depth 2", 2, false, "a.txt,sub,sub/b.txt,sub/deep"},
+		{"depth 3", 3, false, "a.txt,sub,sub/b.txt,sub/deep,sub/deep/c.txt"},
+		{"hidden files", 1, true, ".hidden,a.txt,sub"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.FileOperation(&model.FileOperationRequest{
+				Command:    "list",
+				Path:       dir,
+				MaxDepth:   tt.maxDepth,
+				ShowHidden: tt.showHidden,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := entryNames(resp); got != tt.want {
+				t.Errorf("entries = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListRespectsGitignore(t *testing.T) {
+	s, dir := newTestFileService(t)
+	writeTestTree(t, dir, "a.log", "keep.log", "main.go", "build/out.txt", "src/b.log", "src/build", "src/gen.go")
+	// build/ 只匹配目录，src/build 是普通文件；子目录的 .gitignore 只作用于该目录
+	if err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*.log\n!keep.log\nbuild/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "src", ".gitignore"), []byte("gen.go\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		respectGitignore bool
+		want             string
+	}{
+		{"ignored", true, "keep.log,main.go,src,src/build"},
+		{"not ignored", false, "a.log,build,build/out.txt,keep.log,main.go,src,src/b.log,src/build,src/gen.go"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.FileOperation(&model.FileOperationRequest{
+				Command:          "list",
+				Path:             dir,
+				MaxDepth:         2,
+				RespectGitignore: tt.respectGitignore,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := entryNames(resp); got != tt.want {
+				t.Errorf("entries = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,751 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"litterbox-agent/internal/model"
+)
+
+// defaultPatchFuzz is the number of leading and trailing context lines of a
+// hunk that apply_patch may ignore when the hunk does not match exactly, like
+// the default fuzz factor of GNU patch
+const defaultPatchFuzz = 2
+
+// devNull is the file name a unified diff uses for the missing side of a
+// created or deleted file
+const devNull = "/dev/null"
+
+// filePatch is the part of a unified diff that touches one file
+type filePatch struct {
+	oldName     string
+	newName     string
+	create      bool
+	delete      bool
+	hunks       []*hunk
+	unsupported string // 不支持的变更，如重命名和二进制文件
+}
+
+// name returns the path of the file the patch applies to
+func (f *filePatch) name() string {
+	if f.delete {
+		return f.oldName
+	}
+	return f.newName
+}
+
+func (f *filePatch) action() string {
+	switch {
+	case f.create:
+		return "create"
+	case f.delete:
+		return "delete"
+	}
+	return "modify"
+}
+
+// hunk is one @@ section of a file patch
+type hunk struct {
+	oldStart   int  // 旧文件中的起始行号
+	positioned bool // hunk 头是否包含行号
+	lines      []hunkLine
+	oldNoEOL   bool // 旧文件的最后一行没有换行符
+	newNoEOL   bool // 新文件的最后一行没有换行符
+	oldLeft    int  // hunk 头中的旧文件行数尚未读到的部分
+	newLeft    int  // hunk 头中的新文件行数尚未读到的部分
+}
+
+type hunkLine struct {
+	op   byte // ' ', '-', '+'
+	text string
+	bare bool // 空行，上下文行前的空格可能被编辑器删除
+}
+
+// hunkHeader matches "@@ -l,s +l,s @@"; the counts are optional
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+\d+(?:,(\d+))? @@`)
+
+// parsePatch splits a unified diff, as produced by diff -u or git diff, into
+// the changes of each file. Until the line counts in its header are used up,
+// a hunk takes every line that can be part of it, so removed and added lines
+// such as "-- x" or "++ y" are not mistaken for a ---/+++ file header. The
+// counts are not trusted beyond that, since hand-written and generated diffs
+// often get them wrong: after them, or in a hunk header without line numbers,
+// a hunk ends at the first line that cannot be part of it.
+func parsePatch(patch string) ([]*filePatch, error) {
+	lines := strings.Split(strings.ReplaceAll(patch, "\r\n", "\n"), "\n")
+
+	var (
+		files   []*filePatch
+		file    *filePatch
+		current *hunk
+		// 由 diff --git 开始、尚未遇到 ---/+++ 的文件，其后的扩展头属于它
+		gitHeader bool
+	)
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		if current != nil && (current.oldLeft > 0 || current.newLeft > 0) && current.add(line) {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			file = &filePatch{}
+			file.oldName, file.newName = parseGitNames(strings.TrimPrefix(line, "diff --git "))
+			files = append(files, file)
+			current, gitHeader = nil, true
+			continue
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			if !gitHeader {
+				file = &filePatch{}
+				files = append(files, file)
+			}
+			file.oldName = parseFileName(strings.TrimPrefix(line, "--- "))
+			file.newName = parseFileName(strings.TrimPrefix(lines[i+1], "+++ "))
+			i++
+			current, gitHeader = nil, false
+			continue
+		case strings.HasPrefix(line, "@@"):
+			if file == nil {
+				return nil, newError(CodeInvalidRequest, "invalid patch: hunk at line %d has no file header", i+1)
+			}
+			current = &hunk{}
+			if m := hunkHeader.FindStringSubmatch(line); m != nil {
+				current.oldStart, _ = strconv.Atoi(m[1])
+				current.positioned = true
+				current.oldLeft, current.newLeft = hunkCount(m[2]), hunkCount(m[3])
+			}
+			file.hunks = append(file.hunks, current)
+			gitHeader = false
+			continue
+		}
+
+		if current != nil {
+			if current.add(line) {
+				continue
+			}
+			current = nil
+		}
+
+		if gitHeader {
+			switch {
+			case strings.HasPrefix(line, "new file mode"):
+				file.create = true
+			case strings.HasPrefix(line, "deleted file mode"):
+				file.delete = true
+			case strings.HasPrefix(line, "rename from"), strings.HasPrefix(line, "copy from"):
+				file.unsupported = "renames and copies are not supported"
+			case strings.HasPrefix(line, "Binary files"), strings.HasPrefix(line, "GIT binary patch"):
+				file.unsupported = "binary patches are not supported"
+			}
+		}
+	}
+
+	for _, file := range files {
+		for _, h := range file.hunks {
+			// 文件之间的空行不属于 hunk
+			for n := len(h.lines); n > 0 && h.lines[n-1].bare; n-- {
+				h.lines = h.lines[:n-1]
+			}
+		}
+
+		if file.oldName == devNull {
+			file.create = true
+		}
+		if file.newName == devNull {
+			file.delete = true
+		}
+		// git 风格的 a/ 和 b/ 前缀
+		if (strings.HasPrefix(file.oldName, "a/") || file.oldName == devNull) && (strings.HasPrefix(file.newName, "b/") || file.newName == devNull) {
+			file.oldName = strings.TrimPrefix(file.oldName, "a/")
+			file.newName = strings.TrimPrefix(file.newName, "b/")
+		}
+		if file.name() == "" || file.name() == devNull {
+			return nil, newError(CodeInvalidRequest, "invalid patch: file header without a file name")
+		}
+	}
+	return files, nil
+}
+
+// hunkCount returns a line count of a hunk header, which is 1 when omitted
+func hunkCount(s string) int {
+	if s == "" {
+		return 1
+	}
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// add appends line to the hunk and reports whether it can be part of it
+func (h *hunk) add(line string) bool {
+	switch {
+	case line == "":
+		h.lines = append(h.lines, hunkLine{op: ' ', bare: true})
+	case line[0] == ' ' || line[0] == '-' || line[0] == '+':
+		h.lines = append(h.lines, hunkLine{op: line[0], text: line[1:]})
+	case line[0] == '\\':
+		// "\ No newline at end of file" 作用于上一行
+		if n := len(h.lines); n > 0 {
+			switch h.lines[n-1].op {
+			case '-':
+				h.oldNoEOL = true
+			case '+':
+				h.newNoEOL = true
+			default:
+				h.oldNoEOL, h.newNoEOL = true, true
+			}
+		}
+		return true
+	default:
+		return false
+	}
+
+	switch h.lines[len(h.lines)-1].op {
+	case ' ':
+		h.oldLeft--
+		h.newLeft--
+	case '-':
+		h.oldLeft--
+	case '+':
+		h.newLeft--
+	}
+	return true
+}
+
+// parseFileName returns the file name of a ---/+++ header line, which may be
+// quoted and followed by a tab and a timestamp
+func parseFileName(s string) string {
+	if strings.HasPrefix(s, `"`) {
+		if quoted, err := strconv.QuotedPrefix(s); err == nil {
+			name, _ := strconv.Unquote(quoted)
+			return name
+		}
+	}
+	name, _, _ := strings.Cut(s, "\t")
+	return strings.TrimRight(name, " ")
+}
+
+// parseGitNames returns the file names of a "diff --git a/x b/y" line, which
+// are only needed when the patch has no ---/+++ header, like for an empty
+// new file
+func parseGitNames(s string) (string, string) {
+	if strings.HasPrefix(s, `"`) {
+		if quoted, err := strconv.QuotedPrefix(s); err == nil {
+			oldName, _ := strconv.Unquote(quoted)
+			return oldName, parseFileName(strings.TrimSpace(s[len(quoted):]))
+		}
+	}
+	if i := strings.Index(s, " b/"); i >= 0 {
+		return s[:i], parseFileName(s[i+1:])
+	}
+	oldName, newName, _ := strings.Cut(s, " ")
+	return oldName, parseFileName(newName)
+}
+
+// patchedFile is the content of a file after applying its patch in memory
+type patchedFile struct {
+	patch   *filePatch
+	result  *model.PatchFileResult
+	content string      // 原内容
+	mode    os.FileMode // 原文件的权限，删除后恢复时使用
+	patched string      // 应用后的内容
+	dirs    []string    // 为新文件创建的目录，从深到浅排列
+}
+
+// write stores the patched file, or removes it for a deletion
+func (f *patchedFile) write(s *FileService) error {
+	path := f.result.Path
+	switch f.result.Action {
+	case "create":
+		f.dirs = s.missingDirs(filepath.Dir(path))
+		if err := s.policy.mkdirAll(filepath.Dir(path)); err != nil {
+			s.removeDirs(f.dirs)
+			return err
+		}
+		if err := s.writeFileAtomic(path, []byte(f.patched)); err != nil {
+			s.removeDirs(f.dirs)
+			return err
+		}
+		return nil
+	case "delete":
+		return s.policy.at(path, os.Remove)
+	}
+	return s.writeFileAtomic(path, []byte(f.patched))
+}
+
+// restore undoes write
+func (f *patchedFile) restore(s *FileService) error {
+	path := f.result.Path
+	switch f.result.Action {
+	case "create":
+		if err := s.policy.at(path, os.Remove); err != nil {
+			return err
+		}
+		s.removeDirs(f.dirs)
+		return nil
+	case "delete":
+		if err := s.writeFileAtomic(path, []byte(f.content)); err != nil {
+			return err
+		}
+		return s.policy.chmod(path, f.mode)
+	}
+	return s.writeFileAtomic(path, []byte(f.content))
+}
+
+// applyPatch applies a unified diff touching any number of files. File names
+// in the patch are relative to req.Path, which may also be the file itself
+// when the patch touches a single file. Every hunk is applied in memory first
+// and nothing is written unless all of them apply. If writing one of the
+// files fails, the files written before it are restored, so a patch is
+// applied completely or not at all; each touched file gets its own undo_edit
+// entry once all of them have been written.
+func (s *FileService) applyPatch(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
+	patches, err := parsePatch(req.Patch)
+	if err != nil {
+		return nil, err
+	}
+	if len(patches) == 0 {
+		return nil, newError(CodeInvalidRequest, "patch contains no file changes")
+	}
+
+	fuzz := defaultPatchFuzz
+	if req.Fuzz != nil {
+		fuzz = *req.Fuzz
+	}
+
+	targets, err := s.patchTargets(req.Path, patches)
+	if err != nil {
+		return nil, err
+	}
+
+	// 按路径顺序加锁，避免两个补丁互相等待
+	sorted := slices.Clone(targets)
+	sort.Strings(sorted)
+	for _, path := range sorted {
+		defer s.lockPath(path)()
+	}
+
+	files := make([]*patchedFile, len(patches))
+	results := make([]*model.PatchFileResult, len(patches))
+	failed, hunks := 0, 0
+	for i, patch := range patches {
+		file, err := s.patchFile(targets[i], patch, fuzz)
+		if err != nil {
+			return nil, err
+		}
+		files[i], results[i] = file, file.result
+		hunks += len(patch.hunks)
+		if file.result.Error != "" {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return &model.FileOperationResponse{
+			Success: false,
+			Message: fmt.Sprintf("patch cannot be applied to %d of %d files; no changes were written", failed, len(files)),
+			Files:   results,
+		}, nil
+	}
+	if req.DryRun {
+		return &model.FileOperationResponse{
+			Success: true,
+			Message: fmt.Sprintf("%d hunks would apply to %d files; dry run, no changes were written", hunks, len(files)),
+			Files:   results,
+		}, nil
+	}
+
+	for i, file := range files {
+		if err := file.write(s); err != nil {
+			// 恢复已经写入的文件，补丁仍然要么全部应用要么完全不应用
+			for _, written := range files[:i] {
+				if restoreErr := written.restore(s); restoreErr != nil {
+					err = fmt.Errorf("%w; restoring %s also failed: %v", err, written.result.Path, restoreErr)
+				}
+			}
+			return nil, err
+		}
+	}
+
+	// 全部写入成功后才记录编辑历史
+	for _, file := range files {
+		path := file.result.Path
+		switch file.result.Action {
+		case "create":
+			s.pushHistory(path, historyEntry{absent: true, dirs: file.dirs})
+		case "delete":
+			s.pushHistory(path, historyEntry{content: file.content, mode: file.mode})
+		default:
+			s.addHistory(path, file.content)
+		}
+		if file.result.Action != "delete" {
+			file.result.ETag = contentETag([]byte(file.patched))
+		}
+	}
+
+	return &model.FileOperationResponse{
+		Success: true,
+		Message: fmt.Sprintf("Applied %d hunks to %d files", hunks, len(files)),
+		Files:   results,
+	}, nil
+}
+
+// patchTargets resolves the files a patch touches. base is a directory the
+// file names are relative to, or the file to patch when the patch has a
+// single file section.
+func (s *FileService) patchTargets(base string, patches []*filePatch) ([]string, error) {
+	if !s.isDir(base) {
+		if len(patches) != 1 {
+			return nil, newError(CodeInvalidRequest, "path must be a directory for a patch that touches %d files", len(patches))
+		}
+		return []string{base}, nil
+	}
+
+	targets := make([]string, len(patches))
+	seen := make(map[string]bool)
+	for i, patch := range patches {
+		name := patch.name()
+		if !filepath.IsLocal(name) {
+			return nil, newError(CodeInvalidRequest, "invalid file name in patch: %s", name)
+		}
+		target, err := s.policy.resolve(filepath.Join(base, name))
+		if err != nil {
+			return nil, err
+		}
+		if seen[target] {
+			return nil, newError(CodeInvalidRequest, "patch touches %s more than once", name)
+		}
+		seen[target] = true
+		targets[i] = target
+	}
+	return targets, nil
+}
+
+// isDir reports whether the canonical path is a directory, opened through
+// the path policy
+func (s *FileService) isDir(path string) bool {
+	f, err := s.policy.openRead(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	return err == nil && info.IsDir()
+}
+
+// patchFile applies the hunks of patch to the file at path in memory. Reasons
+// the patch does not apply are reported in the result rather than as errors.
+func (s *FileService) patchFile(path string, patch *filePatch, fuzz int) (*patchedFile, error) {
+	result := &model.PatchFileResult{Path: path, Action: patch.action()}
+	file := &patchedFile{patch: patch, result: result}
+	if patch.unsupported != "" {
+		result.Error = patch.unsupported
+		return file, nil
+	}
+
+	data, err := s.readWithMode(path, file)
+	switch {
+	case err == nil && patch.create:
+		result.Error = "file already exists"
+		return file, nil
+	case errors.Is(err, fs.ErrNotExist) && !patch.create:
+		result.Error = "file does not exist"
+		return file, nil
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+	file.content = string(data)
+
+	patched, hunks, ok := applyHunks(file.content, patch.hunks, fuzz)
+	result.Hunks = hunks
+	switch {
+	case !ok:
+		result.Error = "hunks do not apply"
+	case patch.delete && len(patch.hunks) > 0 && patched != "":
+		result.Error = "file still has content after removing the lines in the patch"
+	}
+	file.patched = patched
+	return file, nil
+}
+
+// readWithMode reads the file at path and records its mode in file, both
+// through the same descriptor opened by the path policy
+func (s *FileService) readWithMode(path string, file *patchedFile) ([]byte, error) {
+	f, err := s.policy.openRead(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	file.mode = info.Mode()
+	return io.ReadAll(f)
+}
+
+// missingDirs returns dir and those of its parents that do not exist, the
+// deepest first
+func (s *FileService) missingDirs(dir string) []string {
+	var missing []string
+	for dir != "/" {
+		err := s.policy.at(dir, func(path string) error {
+			_, err := os.Lstat(path)
+			return err
+		})
+		if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		missing = append(missing, dir)
+		dir = filepath.Dir(dir)
+	}
+	return missing
+}
+
+// removeDirs removes the directories created for a file, deepest first. One
+// that is no longer empty is kept, and so are its parents.
+func (s *FileService) removeDirs(dirs []string) {
+	for _, dir := range dirs {
+		if err := s.policy.at(dir, os.Remove); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return
+		}
+	}
+}
+
+// hunkMatch is where a hunk applies in the lines of a file
+type hunkMatch struct {
+	pos   int // 去掉首尾上下文后的第一行的位置
+	lead  int // 忽略的开头上下文行数
+	trail int // 忽略的末尾上下文行数
+	fuzz  int
+}
+
+// applyHunks applies hunks to content in order. Each hunk is placed at the
+// match of its old lines nearest to the line its header names, adjusted by
+// where the previous hunks applied; when there is none, up to fuzz leading
+// and trailing context lines are ignored. Lines added to a CRLF file get CRLF
+// line endings.
+func applyHunks(content string, hunks []*hunk, fuzz int) (string, []*model.PatchHunkResult, bool) {
+	lines, finalNL := splitLines(content)
+	cr := ""
+	if lineEnding(content) == "\r\n" {
+		cr = "\r"
+	}
+
+	results := make([]*model.PatchHunkResult, len(hunks))
+	// shift 是上一个 hunk 的实际位置相对 hunk 头的偏移，delta 是之前的 hunk 增减的行数
+	shift, delta, minPos, ok := 0, 0, 0, true
+	for i, h := range hunks {
+		result := &model.PatchHunkResult{Index: i + 1}
+		results[i] = result
+
+		m, found := h.locate(lines, minPos, shift, fuzz)
+		if !found {
+			result.Error = h.failure(lines, fuzz)
+			ok = false
+			continue
+		}
+
+		replacement, oldLen := h.replacement(lines, m, cr)
+		atEOF := m.pos+oldLen == len(lines) && m.trail == 0
+		lines = slices.Replace(lines, m.pos, m.pos+oldLen, replacement...)
+		if atEOF {
+			finalNL = !h.newNoEOL
+		}
+
+		result.Applied = true
+		result.Line = m.pos - m.lead + 1
+		result.Fuzz = m.fuzz
+		if origin := h.origin(); origin >= 0 {
+			result.Offset = m.pos - m.lead - origin - delta
+			shift = m.pos - m.lead - origin + len(replacement) - oldLen
+		}
+		delta += len(replacement) - oldLen
+		minPos = m.pos + len(replacement)
+	}
+
+	return joinLines(lines, finalNL, cr), results, ok
+}
+
+// origin returns the index of the first line of the hunk in the original
+// file, or -1 when its header has no line numbers. A hunk without old lines
+// inserts after the line it names.
+func (h *hunk) origin() int {
+	switch {
+	case !h.positioned:
+		return -1
+	case len(h.oldLines()) == 0:
+		return h.oldStart
+	}
+	return max(h.oldStart-1, 0)
+}
+
+// oldLines returns the context and removed lines of the hunk
+func (h *hunk) oldLines() []string {
+	return h.side('-')
+}
+
+// newLines returns the context and added lines of the hunk
+func (h *hunk) newLines() []string {
+	return h.side('+')
+}
+
+func (h *hunk) side(op byte) []string {
+	var lines []string
+	for _, l := range h.lines {
+		if l.op == ' ' || l.op == op {
+			lines = append(lines, l.text)
+		}
+	}
+	return lines
+}
+
+// context returns the number of context lines before the first and after the
+// last change of the hunk
+func (h *hunk) context() (int, int) {
+	lead, trail := 0, 0
+	for lead < len(h.lines) && h.lines[lead].op == ' ' {
+		lead++
+	}
+	for trail < len(h.lines)-lead && h.lines[len(h.lines)-1-trail].op == ' ' {
+		trail++
+	}
+	return lead, trail
+}
+
+// locate finds where the hunk applies at or after minPos, ignoring more
+// context lines at each fuzz level but never all of the old lines
+func (h *hunk) locate(lines []string, minPos, shift, fuzz int) (hunkMatch, bool) {
+	old := h.oldLines()
+	leadContext, trailContext := h.context()
+
+	for level := 0; level <= fuzz; level++ {
+		lead, trail := min(level, leadContext), min(level, trailContext)
+		if level > 0 && lead == min(level-1, leadContext) && trail == min(level-1, trailContext) {
+			continue
+		}
+		if len(old) > 0 && lead+trail >= len(old) {
+			break
+		}
+
+		expected := minPos
+		if origin := h.origin(); origin >= 0 {
+			expected = origin + shift + lead
+		}
+		if pos, ok := nearestMatch(lines, old[lead:len(old)-trail], minPos, expected); ok {
+			return hunkMatch{pos: pos, lead: lead, trail: trail, fuzz: level}, true
+		}
+	}
+	return hunkMatch{}, false
+}
+
+// replacement returns the lines that replace the matched old lines, and the
+// number of old lines. Context lines are taken from the file, so that they
+// keep their exact content.
+func (h *hunk) replacement(lines []string, m hunkMatch, cr string) ([]string, int) {
+	var out []string
+	i := m.pos
+	for _, l := range h.lines[m.lead : len(h.lines)-m.trail] {
+		switch l.op {
+		case ' ':
+			out = append(out, lines[i])
+			i++
+		case '-':
+			i++
+		case '+':
+			out = append(out, l.text+cr)
+		}
+	}
+	return out, i - m.pos
+}
+
+// failure describes why the hunk does not apply to lines
+func (h *hunk) failure(lines []string, fuzz int) string {
+	newLines := h.newLines()
+	if len(newLines) > 0 && !slices.Equal(newLines, h.oldLines()) {
+		if pos, ok := nearestMatch(lines, newLines, 0, 0); ok {
+			return fmt.Sprintf("hunk does not match the file; it appears to be already applied at line %d", pos+1)
+		}
+	}
+	return fmt.Sprintf("hunk does not match the file, even ignoring up to %d context lines", fuzz)
+}
+
+// nearestMatch returns the position at or after minPos where pattern occurs
+// in lines that is nearest to expected. Trailing carriage returns of lines
+// are ignored. An empty pattern matches at expected.
+func nearestMatch(lines, pattern []string, minPos, expected int) (int, bool) {
+	if len(pattern) == 0 {
+		return min(max(expected, minPos), len(lines)), true
+	}
+
+	best := -1
+	for pos := minPos; pos+len(pattern) <= len(lines); pos++ {
+		if !matchAt(lines, pattern, pos) {
+			continue
+		}
+		if best < 0 || abs(pos-expected) < abs(best-expected) {
+			best = pos
+		}
+	}
+	return best, best >= 0
+}
+
+func matchAt(lines, pattern []string, pos int) bool {
+	for j, text := range pattern {
+		if strings.TrimSuffix(lines[pos+j], "\r") != text {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// splitLines splits content into lines without their "\n" and reports
+// whether the last line ends with a newline
+func splitLines(content string) ([]string, bool) {
+	if content == "" {
+		return nil, false
+	}
+	lines := strings.Split(content, "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1], true
+	}
+	return lines, false
+}
+
+// joinLines is the inverse of splitLines. cr is "\r" for CRLF content, whose
+// lines keep their carriage return, so that only the last line may need one
+// added or removed.
+func joinLines(lines []string, finalNL bool, cr string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	if cr != "" {
+		last := &lines[len(lines)-1]
+		if finalNL && !strings.HasSuffix(*last, cr) {
+			*last += cr
+		} else if !finalNL {
+			*last = strings.TrimSuffix(*last, cr)
+		}
+	}
+	content := strings.Join(lines, "\n")
+	if finalNL {
+		content += "\n"
+	}
+	return content
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"litterbox-agent/internal/model"
+)
+
+// hunkText returns the lines of a hunk in diff form
+func hunkText(h *hunk) []string {
+	lines := make([]string, len(h.lines))
+	for i, l := range h.lines {
+		lines[i] = string(l.op) + l.text
+	}
+	return lines
+}
+
+func TestParsePatchHeaderLikeLinesInHunk(t *testing.T) {
+	// 删除以 "-- " 开头的行并添加以 "++ " 开头的行，形如 ---/+++ 文件头
+	patch := strings.Join([]string{
+		"--- a/query.sql",
+		"+++ b/query.sql",
+		"@@ -1,3 +1,3 @@",
+		" SELECT 1;",
+		"--- old comment",
+		"+++ new comment",
+		" SELECT 2;",
+		"--- a/other.txt",
+		"+++ b/other.txt",
+		"@@ -1 +1 @@",
+		"-x",
+		"+y",
+		"",
+	}, "\n")
+
+	files, err := parsePatch(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].name() != "query.sql" || files[1].name() != "other.txt" {
+		t.Fatalf("parsed %d files, want query.sql and other.txt", len(files))
+	}
+
+	want := []string{" SELECT 1;", "--- old comment", "+++ new comment", " SELECT 2;"}
+	if got := hunkText(files[0].hunks[0]); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("hunk lines = %q, want %q", got, want)
+	}
+	if got := hunkText(files[1].hunks[0]); strings.Join(got, ",") != "-x,+y" {
+		t.Errorf("second file hunk lines = %q, want [-x +y]", got)
+	}
+}
+
+func TestParsePatchWrongCounts(t *testing.T) {
+	// 行数偏小时 hunk 仍然延续到不能属于它的行为止，偏大时在下一个 diff --git 或 @@ 处结束
+	patch := strings.Join([]string{
+		"diff --git a/a.txt b/a.txt",
+		"--- a/a.txt",
+		"+++ b/a.txt",
+		"@@ -1,1 +1,1 @@",
+		" one",
+		"-two",
+		"+zwei",
+		"@@ -10,9 +10,9 @@",
+		"-ten",
+		"+zehn",
+		"diff --git a/b.txt b/b.txt",
+		"new file mode 100644",
+		"--- /dev/null",
+		"+++ b/b.txt",
+		"@@",
+		"+new",
+	}, "\n")
+
+	files, err := parsePatch(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("parsed %d files, want 2", len(files))
+	}
+	a, b := files[0], files[1]
+	if len(a.hunks) != 2 || len(a.hunks[0].lines) != 3 || len(a.hunks[1].lines) != 2 {
+		t.Errorf("a.txt hunks = %d, want 2 hunks of 3 and 2 lines", len(a.hunks))
+	}
+	if b.name() != "b.txt" || !b.create || len(b.hunks) != 1 || b.hunks[0].positioned {
+		t.Errorf("b.txt = %+v, want a created file with one hunk without line numbers", b)
+	}
+}
+
+func TestApplyHunksFuzz(t *testing.T) {
+	content := "one\ntwo\nthree\nfour\nfive\n"
+	// 首尾的上下文行与文件不一致
+	patch := strings.Join([]string{
+		"--- a/f",
+		"+++ b/f",
+		"@@ -1,5 +1,5 @@",
+		" uno",
+		" two",
+		"-three",
+		"+drei",
+		" four",
+		" cinco",
+	}, "\n")
+	files, err := parsePatch(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, results, ok := applyHunks(content, files[0].hunks, 0); ok || results[0].Applied {
+		t.Error("hunk with mismatched context applied without fuzz")
+	}
+
+	patched, results, ok := applyHunks(content, files[0].hunks, 1)
+	if !ok || patched != "one\ntwo\ndrei\nfour\nfive\n" {
+		t.Fatalf("patched = %q, %v; want three replaced", patched, ok)
+	}
+	if r := results[0]; r.Fuzz != 1 || r.Line != 1 || r.Offset != 0 {
+		t.Errorf("hunk result = %+v, want fuzz 1 at line 1", r)
+	}
+}
+
+func TestApplyHunksOffset(t *testing.T) {
+	content := "a\nb\nc\nd\ne\nf\n"
+	// hunk 头的行号偏了两行
+	patch := strings.Join([]string{
+		"--- a/f",
+		"+++ b/f",
+		"@@ -1,3 +1,3 @@",
+		" c",
+		"-d",
+		"+D",
+		" e",
+	}, "\n")
+	files, err := parsePatch(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patched, results, ok := applyHunks(content, files[0].hunks, 0)
+	if !ok || patched != "a\nb\nc\nD\ne\nf\n" {
+		t.Fatalf("patched = %q, %v", patched, ok)
+	}
+	if r := results[0]; r.Line != 3 || r.Offset != 2 || r.Fuzz != 0 {
+		t.Errorf("hunk result = %+v, want line 3, offset 2", r)
+	}
+}
+
+func TestApplyPatchRollsBackWhenAWriteFails(t *testing.T) {
+	s, dir := newTestFileService(t)
+	first := filepath.Join(dir, "a.txt")
+	// 同目录下的临时文件名超出长度限制，因此写入第二个文件失败
+	long := strings.Repeat("x", 250)
+	second := filepath.Join(dir, long)
+	writeTestFile(t, first, []string{"one"})
+	writeTestFile(t, second, []string{"two"})
+
+	patch := strings.Join([]string{
+		"--- a/a.txt",
+		"+++ b/a.txt",
+		"@@ -1 +1 @@",
+		"-one",
+		"+uno",
+		"--- /dev/null",
+		"+++ b/sub/dir/new.txt",
+		"@@ -0,0 +1 @@",
+		"+created",
+		"--- a/" + long,
+		"+++ b/" + long,
+		"@@ -1 +1 @@",
+		"-two",
+		"+dos",
+	}, "\n")
+
+	_, err := s.FileOperation(&model.FileOperationRequest{Command: "apply_patch", Path: dir, Patch: patch})
+	if err == nil {
+		t.Fatal("want the patch to fail")
+	}
+
+	if got := strings.Join(readTestLines(t, first), ","); got != "one" {
+		t.Errorf("a.txt = %q, want it restored", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub")); !os.IsNotExist(err) {
+		t.Errorf("directories created for new.txt were not removed: %v", err)
+	}
+	if got := strings.Join(readTestLines(t, second), ","); got != "two" {
+		t.Errorf("%s = %q, want it untouched", long, got)
+	}
+
+	for _, path := range []string{first, filepath.Join(dir, "sub/dir/new.txt")} {
+		resp, err := s.FileOperation(&model.FileOperationRequest{Command: "undo_edit", Path: path})
+		if err != nil || resp.Success {
+			t.Errorf("undo_edit %s = %+v, %v; want no history", path, resp, err)
+		}
+	}
+}
+
+func TestUndoApplyPatchRestoresDeletedFileAndRemovesCreatedDirs(t *testing.T) {
+	s, dir := newTestFileService(t)
+	old := filepath.Join(dir, "old.sh")
+	writeTestFile(t, old, []string{"echo old"})
+	if err := os.Chmod(old, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	patch := strings.Join([]string{
+		"--- a/old.sh",
+		"+++ /dev/null",
+		"@@ -1 +0,0 @@",
+		"-echo old",
+		"--- /dev/null",
+		"+++ b/src/pkg/util/new.go",
+		"@@ -0,0 +1 @@",
+		"+package util",
+	}, "\n")
+	mustOperate(t, s, &model.FileOperationRequest{Command: "apply_patch", Path: dir, Patch: patch})
+
+	mustOperate(t, s, &model.FileOperationRequest{Command: "undo_edit", Path: old})
+	info, err := os.Stat(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("restored old.sh has mode %o, want 0750", info.Mode().Perm())
+	}
+
+	mustOperate(t, s, &model.FileOperationRequest{Command: "undo_edit", Path: filepath.Join(dir, "src/pkg/util/new.go")})
+	if _, err := os.Stat(filepath.Join(dir, "src/pkg")); !os.IsNotExist(err) {
+		t.Errorf("directories created by the patch were not removed: %v", err)
+	}
+	// 补丁之前就存在的目录保留
+	if _, err := os.Stat(filepath.Join(dir, "src")); err != nil {
+		t.Errorf("existing directory was removed: %v", err)
+	}
+}
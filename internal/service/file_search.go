@@ -0,0 +1,288 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"litterbox-agent/internal/model"
+)
+
+const (
+	defaultSearchResults = 1000
+	maxSearchResults     = 10000
+	maxSearchContext     = 100
+	maxSearchFileSize    = 16 << 20 // 更大的文件不搜索
+	maxSearchLineBytes   = 1000     // 返回的每行文本的最大字节数
+	binaryCheckBytes     = 8000     // 检查前多少字节中是否有 NUL 以判断二进制文件
+)
+
+// searcher holds the compiled settings of one search request
+type searcher struct {
+	globFilter
+	re      *regexp.Regexp
+	context int
+	policy  *PathPolicy
+}
+
+// searchFiles searches the files below a path, or a single file, for lines
+// matching a regular expression or a literal string. Files are searched in
+// parallel; binary files and files larger than 16 MiB are skipped. Matches
+// are ordered by path, in the order of the walk, and line number. When there
+// are more than maxResults matches, the first maxResults in that order are
+// returned regardless of which files the workers finished first.
+func (s *FileService) searchFiles(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
+	expr := req.Pattern
+	if req.Literal {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if req.CaseInsensitive {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, newError(CodeInvalidRequest, "invalid pattern: %v", err)
+	}
+
+	maxResults := req.MaxResults
+	if maxResults <= 0 {
+		maxResults = defaultSearchResults
+	}
+	if maxResults > maxSearchResults {
+		maxResults = maxSearchResults
+	}
+
+	sr := &searcher{
+		globFilter: globFilter{root: req.Path, include: req.Include, exclude: req.Exclude},
+		re:         re,
+		context:    req.ContextLines,
+		policy:     s.policy,
+	}
+	if sr.context < 0 {
+		sr.context = 0
+	}
+	if sr.context > maxSearchContext {
+		sr.context = maxSearchContext
+	}
+
+	info, err := os.Stat(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		sr.root = filepath.Dir(req.Path)
+	}
+
+	// seq 为文件在遍历中的序号，结果按它排序，与 worker 完成的先后无关
+	type searchJob struct {
+		seq  int
+		path string
+	}
+	type searchResult struct {
+		seq     int
+		matches []*model.SearchMatch
+	}
+
+	var (
+		paths   = make(chan searchJob)
+		results = make(chan searchResult)
+		stop    atomic.Bool
+		files   atomic.Int64
+		wg      sync.WaitGroup
+		walkErr error
+	)
+
+	// 搜索主要受 I/O 限制，worker 数量不少于 4 个
+	for i := 0; i < max(runtime.NumCPU(), 4); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range paths {
+				if stop.Load() {
+					continue
+				}
+				matches, searched := sr.searchFile(job.path)
+				if searched {
+					files.Add(1)
+				}
+				results <- searchResult{seq: job.seq, matches: matches}
+			}
+		}()
+	}
+
+	go func() {
+		seq := 0
+		if info.IsDir() {
+			opts := walkOptions{
+				maxDepth:         req.MaxDepth,
+				showHidden:       req.ShowHidden,
+				respectGitignore: req.RespectGitignore,
+			}
+			walkErr = s.policy.walk(req.Path, opts, func(path string, info os.FileInfo, depth int) error {
+				if stop.Load() {
+					return fs.SkipAll
+				}
+				if s.policy.check(path, path) != nil || sr.excluded(path) {
+					return filepath.SkipDir
+				}
+				if info.Mode().IsRegular() && sr.included(path) {
+					paths <- searchJob{seq: seq, path: path}
+					seq++
+				}
+				return nil
+			})
+		} else {
+			paths <- searchJob{path: req.Path}
+		}
+		close(paths)
+		wg.Wait()
+		close(results)
+	}()
+
+	// 只有序号连续的前若干个文件都已搜索完、且其中的匹配超过 maxResults 时才能
+	// 停止：此时结果的前 maxResults 个已经确定，并且确实有匹配被丢弃
+	var found []searchResult
+	done := make(map[int]int) // 已搜索文件的序号 -> 匹配数
+	next, prefixMatches := 0, 0
+	for result := range results {
+		found = append(found, result)
+		done[result.seq] = len(result.matches)
+		for n, ok := done[next]; ok; n, ok = done[next] {
+			prefixMatches += n
+			delete(done, next)
+			next++
+		}
+		if prefixMatches > maxResults {
+			// 通知遍历和其余 worker 尽快结束，剩余结果仍需读完
+			stop.Store(true)
+		}
+	}
+	if walkErr != nil {
+		return nil, walkErr
+	}
+
+	sort.Slice(found, func(a, b int) bool { return found[a].seq < found[b].seq })
+	matches := []*model.SearchMatch{}
+	for _, result := range found {
+		matches = append(matches, result.matches...)
+	}
+	truncated := len(matches) > maxResults
+	if truncated {
+		matches = matches[:maxResults]
+	}
+
+	message := fmt.Sprintf("%d matches in %d files searched", len(matches), files.Load())
+	if truncated {
+		message += fmt.Sprintf(" (stopped at %d results)", maxResults)
+	}
+	return &model.FileOperationResponse{
+		Success:   true,
+		Message:   message,
+		Matches:   matches,
+		Truncated: truncated,
+	}, nil
+}
+
+// searchFile returns the matching lines of one file, and whether the file
+// was searched at all
+func (sr *searcher) searchFile(path string) ([]*model.SearchMatch, bool) {
+	file, err := sr.policy.openFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.Size() > maxSearchFileSize {
+		return nil, false
+	}
+
+	// 先读取开头部分判断是否为二进制文件，避免读入整个二进制文件
+	data := make([]byte, 0, info.Size()+1)
+	n, err := io.ReadFull(file, data[:min(cap(data), binaryCheckBytes)])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, false
+	}
+	if bytes.IndexByte(data[:n], 0) >= 0 {
+		return nil, false
+	}
+	data = data[:n]
+	for {
+		n, err := file.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err == io.EOF || len(data) == cap(data) {
+			break
+		}
+		if err != nil {
+			return nil, false
+		}
+	}
+
+	// 大部分文件没有匹配，整体检查一次可以省去逐行匹配
+	if !sr.re.Match(data) {
+		return nil, true
+	}
+
+	lines := strings.Split(string(data), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+
+	var matches []*model.SearchMatch
+	for i, line := range lines {
+		loc := sr.re.FindStringIndex(line)
+		if loc == nil {
+			continue
+		}
+
+		match := &model.SearchMatch{
+			Path:   path,
+			Line:   i + 1,
+			Column: loc[0] + 1,
+			Text:   clipLine(line),
+		}
+		if sr.context > 0 {
+			match.Before = clipLines(lines[max(0, i-sr.context):i])
+			match.After = clipLines(lines[i+1 : min(len(lines), i+1+sr.context)])
+		}
+		matches = append(matches, match)
+	}
+	return matches, true
+}
+
+// clipLine shortens overly long lines, such as minified code, on a rune
+// boundary
+func clipLine(line string) string {
+	if len(line) <= maxSearchLineBytes {
+		return line
+	}
+	cut := maxSearchLineBytes
+	for cut > 0 && !utf8.RuneStart(line[cut]) {
+		cut--
+	}
+	return line[:cut] + " ..."
+}
+
+func clipLines(lines []string) []string {
+	if len(lines) == 0 {
+		return nil
+	}
+	clipped := make([]string, len(lines))
+	for i, line := range lines {
+		clipped[i] = clipLine(line)
+	}
+	return clipped
+}
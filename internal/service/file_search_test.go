@@ -0,0 +1,130 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"litterbox-agent/internal/model"
+)
+
+// matchPositions formats the matches of a search response as name:line
+func matchPositions(dir string, resp *model.FileOperationResponse) string {
+	positions := make([]string, len(resp.Matches))
+	for i, match := range resp.Matches {
+		rel, _ := filepath.Rel(dir, match.Path)
+		positions[i] = fmt.Sprintf("%s:%d", filepath.ToSlash(rel), match.Line)
+	}
+	return strings.Join(positions, ",")
+}
+
+func TestSearchMatches(t *testing.T) {
+	s, dir := newTestFileService(t)
+	writeTestTree(t, dir, "sub/b.go")
+	writeTestFile(t, filepath.Join(dir, "a.go"), []string{"package a", "", "func Foo() {}", "func bar() {}"})
+	writeTestFile(t, filepath.Join(dir, "sub", "b.go"), []string{"package b", "func FOO() {}"})
+	writeTestFile(t, filepath.Join(dir, "notes.txt"), []string{"Foo in prose"})
+	if err := os.WriteFile(filepath.Join(dir, "bin.go"), []byte("func Foo\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		req     model.FileOperationRequest
+		matches string
+	}{
+		{
+			name:    "regexp",
+			req:     model.FileOperationRequest{Pattern: `func \w+\(`},
+			matches: "a.go:3,a.go:4,sub/b.go:2",
+		},
+		{
+			name:    "include",
+			req:     model.FileOperationRequest{Pattern: "Foo", Include: []string{"*.go"}},
+			matches: "a.go:3",
+		},
+		{
+			name:    "case insensitive, exclude",
+			req:     model.FileOperationRequest{Pattern: "foo", CaseInsensitive: true, Exclude: []string{"*.txt"}},
+			matches: "a.go:3,sub/b.go:2",
+		},
+		{
+			name:    "literal",
+			req:     model.FileOperationRequest{Pattern: "Foo()", Literal: true},
+			matches: "a.go:3",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			req.Command, req.Path = "search", dir
+			resp, err := s.FileOperation(&req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := matchPositions(dir, resp); got != tt.matches {
+				t.Errorf("matches = %s, want %s", got, tt.matches)
+			}
+			if resp.Truncated {
+				t.Error("truncated set without a dropped match")
+			}
+		})
+	}
+
+	resp, err := s.FileOperation(&model.FileOperationRequest{Command: "search", Path: filepath.Join(dir, "a.go"), Pattern: "Foo", ContextLines: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Matches) != 1 || strings.Join(resp.Matches[0].Before, "|") != "" || strings.Join(resp.Matches[0].After, "|") != "func bar() {}" || resp.Matches[0].Column != 6 {
+		t.Errorf("single file search = %+v, want line 3 with one line of context", resp.Matches)
+	}
+}
+
+func TestSearchTruncation(t *testing.T) {
+	s, dir := newTestFileService(t)
+	// 文件数多于 worker 数，结果不能依赖哪个 worker 先完成
+	var want []string
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("f%02d.txt", i)
+		writeTestFile(t, filepath.Join(dir, name), []string{"hit", "miss", "hit"})
+		want = append(want, name+":1", name+":3")
+	}
+
+	for _, tt := range []struct {
+		maxResults int
+		truncated  bool
+	}{
+		{maxResults: 5, truncated: true},
+		{maxResults: 79, truncated: true},
+		{maxResults: 80, truncated: false},
+		{maxResults: 100, truncated: false},
+	} {
+		for run := 0; run < 5; run++ {
+			resp, err := s.FileOperation(&model.FileOperationRequest{Command: "search", Path: dir, Pattern: "hit", MaxResults: tt.maxResults})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := strings.Join(want[:min(tt.maxResults, len(want))], ",")
+			if got := matchPositions(dir, resp); got != expected || resp.Truncated != tt.truncated {
+				t.Fatalf("max_results %d: matches %s, truncated %v; want %s, %v", tt.maxResults, got, resp.Truncated, expected, tt.truncated)
+			}
+		}
+	}
+}
+
+func TestSearchOrderFollowsWalk(t *testing.T) {
+	s, dir := newTestFileService(t)
+	// 按字符串比较 "dir-a" 排在 "dir/x" 之前，遍历顺序则相反
+	writeTestTree(t, dir, "dir/x")
+	writeTestFile(t, filepath.Join(dir, "dir", "x"), []string{"hit"})
+	writeTestFile(t, filepath.Join(dir, "dir-a"), []string{"hit"})
+
+	resp, err := s.FileOperation(&model.FileOperationRequest{Command: "search", Path: dir, Pattern: "hit", MaxResults: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := matchPositions(dir, resp); got != "dir/x:1" || !resp.Truncated {
+		t.Errorf("matches %s, truncated %v; want dir/x:1, true", got, resp.Truncated)
+	}
+}
@@ -2,32 +2,109 @@ package service
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"litterbox-agent/internal/model"
 )
 
-const maxHistorySize = 10
+const (
+	maxHistorySize = 10
+	maxListEntries = 10000 // list 返回的最大目录项数
+)
 
 type FileService struct {
-	editHistory map[string][]string //
+	policy *PathPolicy
+
+	historyMu   sync.Mutex
+	editHistory map[string][]historyEntry
+
+	locksMu sync.Mutex
+	locks   map[string]*pathLock // 正在编辑的文件的锁，不再使用时删除
+}
+
+// historyEntry is a previous version of a file. absent records that the file
+// did not exist, so that undoing its creation removes it again together with
+// the directories created for it.
+type historyEntry struct {
+	content string
+	mode    os.FileMode // 被删除的文件的权限，撤销删除时恢复；为 0 时沿用现有文件的权限
+	absent  bool
+	dirs    []string // 创建文件时新建的目录，从深到浅排列
+}
+
+// pathLock serializes the edits of one file. refs counts the requests
+// holding or waiting for the lock.
+type pathLock struct {
+	mu   sync.Mutex
+	refs int
 }
 
-func NewFileService() *FileService {
+func NewFileService(policy *PathPolicy) *FileService {
 	return &FileService{
-		editHistory: make(map[string][]string),
+		policy:      policy,
+		editHistory: make(map[string][]historyEntry),
+		locks:       make(map[string]*pathLock),
+	}
+}
+
+// lockPath locks path against concurrent edits, so that the read-modify-write
+// of one request cannot interleave with another's. It returns the function
+// that releases the lock.
+func (s *FileService) lockPath(path string) func() {
+	s.locksMu.Lock()
+	l, ok := s.locks[path]
+	if !ok {
+		l = &pathLock{}
+		s.locks[path] = l
+	}
+	l.refs++
+	s.locksMu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+
+		s.locksMu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(s.locks, path)
+		}
+		s.locksMu.Unlock()
+	}
+}
+
+// lockOrder returns the distinct paths among a and b in the order they are
+// locked
+func lockOrder(a, b string) []string {
+	switch {
+	case a == b:
+		return []string{a}
+	case a < b:
+		return []string{a, b}
+	default:
+		return []string{b, a}
 	}
 }
 
 // addHistory adds a history entry for a file, maintaining max size
 func (s *FileService) addHistory(path, content string) {
+	s.pushHistory(path, historyEntry{content: content})
+}
+
+func (s *FileService) pushHistory(path string, entry historyEntry) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
 	history := s.editHistory[path]
-	history = append(history, content)
+	history = append(history, entry)
 
 	if len(history) > maxHistorySize {
 		history = history[len(history)-maxHistorySize:]
@@ -36,48 +113,98 @@ func (s *FileService) addHistory(path, content string) {
 	s.editHistory[path] = history
 }
 
-// UploadFile uploads a file to the specified directory
-func (s *FileService) UploadFile(file multipart.File, header *multipart.FileHeader, uploadDir string) (string, error) {
-	if uploadDir == "" {
-		uploadDir = "/tmp"
-	}
+// popHistory removes and returns the latest history entry of a file
+func (s *FileService) popHistory(path string) (historyEntry, bool) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
 
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		return "", err
+	history := s.editHistory[path]
+	if len(history) == 0 {
+		return historyEntry{}, false
 	}
 
-	dst := filepath.Join(uploadDir, header.Filename)
-	out, err := os.Create(dst)
-	if err != nil {
-		return "", err
+	last := history[len(history)-1]
+	if len(history) == 1 {
+		delete(s.editHistory, path)
+	} else {
+		s.editHistory[path] = history[:len(history)-1]
 	}
-	defer out.Close()
+	return last, true
+}
 
-	if _, err := io.Copy(out, file); err != nil {
-		return "", err
+// uploadDir returns the directory uploads go to when none is given: the
+// workspace root, or /tmp when the workspace is the whole file system
+func (s *FileService) uploadDir(dir string) string {
+	if dir != "" {
+		return dir
 	}
-
-	return dst, nil
+	if s.policy.Root() != "/" {
+		return s.policy.Root()
+	}
+	return "/tmp"
 }
 
 // DownloadFile returns a file from the specified path
 func (s *FileService) DownloadFile(filePath string) (*os.File, os.FileInfo, error) {
-	file, err := os.Open(filePath)
+	filePath, err := s.policy.resolve(filePath)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	file, err := s.policy.openFile(filePath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, nil, classifyFSError(err)
+	}
+
 	stat, err := file.Stat()
 	if err != nil {
 		file.Close()
-		return nil, nil, err
+		return nil, nil, classifyFSError(err)
 	}
 
 	return file, stat, nil
 }
 
-// FileOperation performs unified file operations
+// FileOperation performs unified file operations. Common file system errors
+// are returned as coded errors.
 func (s *FileService) FileOperation(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
+	response, err := s.fileOperation(req)
+	return response, classifyFSError(err)
+}
+
+func (s *FileService) fileOperation(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
+	// 这些命令作用于路径本身，末尾的符号链接不被跟随，由各命令自行解析路径
+	switch req.Command {
+	case "stat":
+		return s.statFile(req)
+	case "delete":
+		return s.deleteFile(req)
+	case "move":
+		return s.moveFile(req)
+	}
+
+	// 之后的操作都使用规范化后的路径，编辑历史也以此为键
+	target, err := s.policy.resolve(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	path := target
+	if req.FollowSymlinks != nil && !*req.FollowSymlinks && isWriteCommand(req.Command) {
+		// 替换符号链接本身而不是写入其目标，原内容仍通过链接读取，因此两者都须检查
+		if path, err = s.policy.resolveNoFollow(req.Path); err != nil {
+			return nil, err
+		}
+	}
+	req.Path = path
+
+	if isWriteCommand(req.Command) {
+		// 通过符号链接编辑时读取的是目标的内容，因此同时锁住链接和目标，
+		// 与直接编辑目标的请求互斥；按路径顺序加锁，避免互相等待
+		for _, p := range lockOrder(path, target) {
+			defer s.lockPath(p)()
+		}
+	}
+
 	switch req.Command {
 	case "view":
 		return s.viewFile(req)
@@ -87,8 +214,25 @@ func (s *FileService) FileOperation(req *model.FileOperationRequest) (*model.Fil
 		return s.strReplace(req)
 	case "insert":
 		return s.insertLine(req)
+	case "multi_edit":
+		return s.multiEdit(req)
+	case "apply_patch":
+		// 补丁可能涉及多个文件，由 applyPatch 自行加锁
+		return s.applyPatch(req)
 	case "undo_edit":
 		return s.undoEdit(req)
+	case "list":
+		return s.listDir(req)
+	case "copy":
+		return s.copyFile(req)
+	case "mkdir":
+		return s.makeDir(req)
+	case "chmod":
+		return s.changeMode(req)
+	case "search":
+		return s.searchFiles(req)
+	case "find":
+		return s.findFiles(req)
 	default:
 		return &model.FileOperationResponse{
 			Success: false,
@@ -97,16 +241,30 @@ func (s *FileService) FileOperation(req *model.FileOperationRequest) (*model.Fil
 	}
 }
 
+// isWriteCommand reports whether command rewrites the content of a file
+func isWriteCommand(command string) bool {
+	switch command {
+	case "create", "str_replace", "insert", "multi_edit", "undo_edit":
+		return true
+	}
+	return false
+}
+
 // viewFile reads and returns file content with optional line range
 func (s *FileService) viewFile(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
-	file, err := os.Open(req.Path)
+	file, err := s.policy.openFile(req.Path, os.O_RDONLY, 0)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
+	if info, err := file.Stat(); err == nil && info.IsDir() {
+		return s.listDir(req)
+	}
+
 	var lines []string
-	scanner := bufio.NewScanner(file)
+	hash := sha256.New()
+	scanner := bufio.NewScanner(io.TeeReader(file, hash))
 	for scanner.Scan() {
 		lines = append(lines, scanner.Text())
 	}
@@ -137,129 +295,260 @@ func (s *FileService) viewFile(req *model.FileOperationRequest) (*model.FileOper
 		Success: true,
 		Content: content,
 		Lines:   totalLines,
+		ETag:    etagOf(hash),
 		Message: fmt.Sprintf("Showing lines %d-%d of %d", start+1, end, totalLines),
 	}, nil
 }
 
-// createFile creates a new file with content
+// listDir returns the entries below a directory, down to the requested depth
+func (s *FileService) listDir(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
+	maxDepth := req.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = 1
+	}
+	opts := walkOptions{
+		maxDepth:         maxDepth,
+		showHidden:       req.ShowHidden,
+		respectGitignore: req.RespectGitignore,
+	}
+
+	entries := []*model.FileEntry{}
+	truncated := false
+	err := s.policy.walk(req.Path, opts, func(path string, info os.FileInfo, depth int) error {
+		// 跳过禁止访问的路径
+		if s.policy.check(path, path) != nil {
+			return filepath.SkipDir
+		}
+		if len(entries) >= maxListEntries {
+			truncated = true
+			return fs.SkipAll
+		}
+		entries = append(entries, fileEntry(req.Path, path, info))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	message := fmt.Sprintf("%d entries in %s", len(entries), req.Path)
+	if truncated {
+		message += fmt.Sprintf(" (truncated at %d)", maxListEntries)
+	}
+	return &model.FileOperationResponse{
+		Success:   true,
+		Message:   message,
+		Entries:   entries,
+		Truncated: truncated,
+	}, nil
+}
+
+// fileEntry describes the file at path, named relative to dir
+func fileEntry(dir, path string, info os.FileInfo) *model.FileEntry {
+	name, err := filepath.Rel(dir, path)
+	if err != nil {
+		name = info.Name()
+	}
+
+	entry := &model.FileEntry{
+		Name:    filepath.ToSlash(name),
+		Path:    path,
+		Type:    fileType(info.Mode()),
+		Size:    info.Size(),
+		Mode:    fmt.Sprintf("%04o", info.Mode().Perm()),
+		ModTime: info.ModTime(),
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		entry.LinkTarget, _ = os.Readlink(path)
+	}
+	return entry
+}
+
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "dir"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "other"
+	}
+}
+
+// createFile creates a new file with content. An existing file is only
+// replaced when overwrite or if_match is set, and can then be restored with
+// undo_edit.
 func (s *FileService) createFile(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
-	if _, err := os.Stat(req.Path); err == nil {
-		return &model.FileOperationResponse{
-			Success: false,
-			Message: "File already exists",
-		}, nil
+	existing, err := s.policy.readFile(req.Path)
+	replacing := err == nil
+	switch {
+	case replacing:
+		if !req.Overwrite && req.IfMatch == "" {
+			return &model.FileOperationResponse{
+				Success: false,
+				Message: "File already exists",
+			}, nil
+		}
+		if err := checkETag(req.Path, req.IfMatch, existing); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		if req.IfMatch != "" {
+			return nil, newError(CodeConflict, "%s does not exist", req.Path)
+		}
+	default:
+		return nil, err
 	}
 
-	dir := filepath.Dir(req.Path)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	if err := s.policy.mkdirAll(filepath.Dir(req.Path)); err != nil {
 		return nil, err
 	}
 
-	if err := os.WriteFile(req.Path, []byte(req.FileText), 0644); err != nil {
+	if err := s.writeFileAtomic(req.Path, []byte(req.FileText)); err != nil {
 		return nil, err
 	}
+	// 写入成功后才记录历史，失败的写入不应留下可撤销的记录
+	if replacing {
+		s.addHistory(req.Path, string(existing))
+	}
 
 	return &model.FileOperationResponse{
 		Success: true,
 		Message: fmt.Sprintf("File created: %s", req.Path),
+		ETag:    contentETag([]byte(req.FileText)),
 	}, nil
 }
 
-// strReplace performs string replacement in file
+// strReplace performs string replacement in file. old_str must match
+// exactly once unless replace_all or occurrence is set; otherwise the edit
+// fails and reports the lines of all matches. In a file with CRLF line
+// endings, old_str and new_str are converted to CRLF first.
 func (s *FileService) strReplace(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
-	data, err := os.ReadFile(req.Path)
+	if failure := validateReplace(req.OldStr, req.ReplaceAll, req.Occurrence); failure != "" {
+		return nil, newError(CodeInvalidRequest, "%s", failure)
+	}
+
+	data, err := s.policy.readFile(req.Path)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := checkETag(req.Path, req.IfMatch, data); err != nil {
+		return nil, err
+	}
 	content := string(data)
 
-	// 保存历史用于undo
-	s.addHistory(req.Path, content)
+	eol := lineEnding(content)
+	oldStr := withLineEnding(req.OldStr, eol)
+	newStr := withLineEnding(req.NewStr, eol)
 
-	if !strings.Contains(content, req.OldStr) {
+	result := replaceString(content, oldStr, newStr, req.ReplaceAll, req.Occurrence)
+	if result.failure != "" {
 		return &model.FileOperationResponse{
-			Success: false,
-			Message: "String not found in file",
+			Success:    false,
+			Message:    result.failure,
+			MatchLines: result.lines,
 		}, nil
 	}
 
-	newContent := strings.Replace(content, req.OldStr, req.NewStr, -1)
-
-	if err := os.WriteFile(req.Path, []byte(newContent), 0644); err != nil {
+	if err := s.writeFileAtomic(req.Path, []byte(result.content)); err != nil {
 		return nil, err
 	}
+	// 保存历史用于undo
+	s.addHistory(req.Path, content)
 
-	count := strings.Count(content, req.OldStr)
+	message := fmt.Sprintf("Replaced %d occurrence(s)", result.count)
+	if result.count == 1 {
+		message = fmt.Sprintf("Replaced 1 occurrence at line %d", result.line)
+	}
 	return &model.FileOperationResponse{
-		Success: true,
-		Message: fmt.Sprintf("Replaced %d occurrence(s)", count),
+		Success:    true,
+		Message:    message,
+		ETag:       contentETag([]byte(result.content)),
+		MatchLines: result.lines,
 	}, nil
 }
 
-// insertLine inserts content after specified line
+// insertLine inserts content after specified line, using the line ending of
+// the file and keeping whether it ends with a newline
 func (s *FileService) insertLine(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
-	// 读取文件
-	file, err := os.Open(req.Path)
+	data, err := s.policy.readFile(req.Path)
 	if err != nil {
 		return nil, err
 	}
 
-	var lines []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
-	}
-	file.Close()
-
-	if err := scanner.Err(); err != nil {
+	if err := checkETag(req.Path, req.IfMatch, data); err != nil {
 		return nil, err
 	}
+	content := string(data)
 
-	s.addHistory(req.Path, strings.Join(lines, "\n"))
-
-	if req.InsertLine < 0 || req.InsertLine > len(lines) {
+	newContent, failure := insertText(content, req.InsertLine, req.NewStr)
+	if failure != "" {
 		return &model.FileOperationResponse{
 			Success: false,
-			Message: fmt.Sprintf("Invalid line number: %d (file has %d lines)", req.InsertLine, len(lines)),
+			Message: failure,
 		}, nil
 	}
 
-	newLines := make([]string, 0, len(lines)+1)
-	newLines = append(newLines, lines[:req.InsertLine]...)
-	newLines = append(newLines, req.NewStr)
-	newLines = append(newLines, lines[req.InsertLine:]...)
-
-	newContent := strings.Join(newLines, "\n")
-	if err := os.WriteFile(req.Path, []byte(newContent), 0644); err != nil {
+	if err := s.writeFileAtomic(req.Path, []byte(newContent)); err != nil {
 		return nil, err
 	}
+	s.addHistory(req.Path, content)
 
 	return &model.FileOperationResponse{
 		Success: true,
 		Message: fmt.Sprintf("Inserted line after line %d", req.InsertLine),
+		ETag:    contentETag([]byte(newContent)),
 	}, nil
 }
 
-// undoEdit undoes the last edit operation
+// undoEdit undoes the last edit operation. Undoing the creation of a file by
+// apply_patch removes the file.
 func (s *FileService) undoEdit(req *model.FileOperationRequest) (*model.FileOperationResponse, error) {
-	history, exists := s.editHistory[req.Path]
-	if !exists || len(history) == 0 {
+	if req.IfMatch != "" {
+		current, err := s.policy.readFile(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkETag(req.Path, req.IfMatch, current); err != nil {
+			return nil, err
+		}
+	}
+
+	lastVersion, ok := s.popHistory(req.Path)
+	if !ok {
 		return &model.FileOperationResponse{
 			Success: false,
 			Message: "No edit history to undo",
 		}, nil
 	}
 
-	lastVersion := history[len(history)-1]
-	s.editHistory[req.Path] = history[:len(history)-1]
+	if lastVersion.absent {
+		if err := s.policy.at(req.Path, os.Remove); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			s.pushHistory(req.Path, lastVersion)
+			return nil, err
+		}
+		s.removeDirs(lastVersion.dirs)
+		return &model.FileOperationResponse{
+			Success: true,
+			Message: fmt.Sprintf("Edit undone successfully; %s was removed", req.Path),
+		}, nil
+	}
 
-	if err := os.WriteFile(req.Path, []byte(lastVersion), 0644); err != nil {
+	if err := s.writeFileAtomic(req.Path, []byte(lastVersion.content)); err != nil {
+		s.pushHistory(req.Path, lastVersion)
 		return nil, err
 	}
+	if lastVersion.mode != 0 {
+		if err := s.policy.chmod(req.Path, lastVersion.mode); err != nil {
+			return nil, err
+		}
+	}
 
 	return &model.FileOperationResponse{
 		Success: true,
 		Message: "Edit undone successfully",
+		ETag:    contentETag([]byte(lastVersion.content)),
 	}, nil
 }
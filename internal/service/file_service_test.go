@@ -0,0 +1,284 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"litterbox-agent/internal/config"
+	"litterbox-agent/internal/model"
+)
+
+// newTestFileService creates a file service whose workspace is a temporary
+// directory
+func newTestFileService(t *testing.T) (*FileService, string) {
+	t.Helper()
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := NewPathPolicy(config.WorkspaceConfig{Root: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFileService(policy), dir
+}
+
+func writeTestFile(t *testing.T, path string, lines []string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// mustOperate runs a file operation and fails the test unless it succeeds
+func mustOperate(t *testing.T, s *FileService, req *model.FileOperationRequest) {
+	t.Helper()
+	resp, err := s.FileOperation(req)
+	if err != nil {
+		t.Errorf("%s %s: %v", req.Command, req.Path, err)
+	} else if !resp.Success {
+		t.Errorf("%s %s: %s", req.Command, req.Path, resp.Message)
+	}
+}
+
+func TestConcurrentEditsToOneFile(t *testing.T) {
+	s, dir := newTestFileService(t)
+	path := filepath.Join(dir, "shared.txt")
+
+	const n = 50
+	slots := make([]string, n)
+	for i := range slots {
+		slots[i] = fmt.Sprintf("slot-%d", i)
+	}
+	writeTestFile(t, path, slots)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			mustOperate(t, s, &model.FileOperationRequest{
+				Command: "str_replace",
+				Path:    path,
+				OldStr:  fmt.Sprintf("slot-%d\n", i),
+				NewStr:  fmt.Sprintf("done-%d\n", i),
+			})
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			mustOperate(t, s, &model.FileOperationRequest{
+				Command:    "insert",
+				Path:       path,
+				InsertLine: 0,
+				NewStr:     fmt.Sprintf("inserted-%d", i),
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	lines := readTestLines(t, path)
+	if len(lines) != 2*n {
+		t.Fatalf("file has %d lines, want %d", len(lines), 2*n)
+	}
+	content := strings.Join(lines, "\n") + "\n"
+	for i := 0; i < n; i++ {
+		if !strings.Contains(content, fmt.Sprintf("done-%d\n", i)) {
+			t.Errorf("replacement of slot-%d was lost", i)
+		}
+		if !strings.Contains(content, fmt.Sprintf("inserted-%d\n", i)) {
+			t.Errorf("insert %d was lost", i)
+		}
+	}
+}
+
+func TestConcurrentInsertsAndUndos(t *testing.T) {
+	s, dir := newTestFileService(t)
+	path := filepath.Join(dir, "undo.txt")
+	writeTestFile(t, path, []string{"base"})
+
+	const n = 40
+	var undone atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			mustOperate(t, s, &model.FileOperationRequest{
+				Command:    "insert",
+				Path:       path,
+				InsertLine: 1,
+				NewStr:     fmt.Sprintf("inserted-%d", i),
+			})
+		}(i)
+		go func() {
+			defer wg.Done()
+			resp, err := s.FileOperation(&model.FileOperationRequest{Command: "undo_edit", Path: path})
+			if err != nil {
+				t.Errorf("undo_edit: %v", err)
+				return
+			}
+			// 历史为空时撤销失败，但不会出错
+			if resp.Success {
+				undone.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 每次成功的撤销恰好去掉一次插入
+	lines := readTestLines(t, path)
+	if want := 1 + n - int(undone.Load()); len(lines) != want {
+		t.Errorf("file has %d lines after %d inserts and %d undos, want %d", len(lines), n, undone.Load(), want)
+	}
+	if lines[0] != "base" {
+		t.Errorf("first line is %q, want %q", lines[0], "base")
+	}
+}
+
+func TestEditThroughSymlinkLocksTarget(t *testing.T) {
+	s, dir := newTestFileService(t)
+	target := filepath.Join(dir, "target.txt")
+	link := filepath.Join(dir, "link.txt")
+	writeTestFile(t, target, []string{"one"})
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟正在编辑目标文件的请求
+	unlock := s.lockPath(target)
+	follow := false
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.FileOperation(&model.FileOperationRequest{
+			Command:        "str_replace",
+			Path:           link,
+			OldStr:         "one",
+			NewStr:         "uno",
+			FollowSymlinks: &follow,
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("edit through the symlink did not wait for the lock on its target: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentEditsToDifferentFiles(t *testing.T) {
+	s, dir := newTestFileService(t)
+
+	const files, edits = 10, 20
+	var wg sync.WaitGroup
+	for f := 0; f < files; f++ {
+		path := filepath.Join(dir, fmt.Sprintf("file-%d.txt", f))
+		writeTestFile(t, path, []string{"count 0"})
+
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			for i := 0; i < edits; i++ {
+				mustOperate(t, s, &model.FileOperationRequest{
+					Command: "str_replace",
+					Path:    path,
+					OldStr:  fmt.Sprintf("count %d", i),
+					NewStr:  fmt.Sprintf("count %d", i+1),
+				})
+			}
+			// 撤销最后一次编辑，历史只属于这个文件
+			mustOperate(t, s, &model.FileOperationRequest{Command: "undo_edit", Path: path})
+		}(path)
+	}
+	wg.Wait()
+
+	for f := 0; f < files; f++ {
+		path := filepath.Join(dir, fmt.Sprintf("file-%d.txt", f))
+		if lines := readTestLines(t, path); len(lines) != 1 || lines[0] != fmt.Sprintf("count %d", edits-1) {
+			t.Errorf("%s = %q, want %q", path, lines, fmt.Sprintf("count %d", edits-1))
+		}
+	}
+
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+	if len(s.locks) != 0 {
+		t.Errorf("%d path locks were not released", len(s.locks))
+	}
+}
+
+func TestFailedWriteRecordsNoHistory(t *testing.T) {
+	patch := strings.Join([]string{"--- a/f", "+++ b/f", "@@ -1 +1 @@", "-one", "+uno"}, "\n")
+	for _, req := range []*model.FileOperationRequest{
+		{Command: "str_replace", OldStr: "one", NewStr: "uno"},
+		{Command: "insert", InsertLine: 1, NewStr: "inserted"},
+		{Command: "create", FileText: "replaced\n", Overwrite: true},
+		{Command: "multi_edit", Edits: []model.FileEdit{{Command: "str_replace", OldStr: "one", NewStr: "uno"}}},
+		{Command: "apply_patch", Patch: patch},
+	} {
+		t.Run(req.Command, func(t *testing.T) {
+			s, dir := newTestFileService(t)
+			// 文件名本身合法，但同目录下的临时文件名超出长度限制，因此写入失败
+			path := filepath.Join(dir, strings.Repeat("x", 250))
+			writeTestFile(t, path, []string{"one", "two"})
+
+			req.Path = path
+			if _, err := s.FileOperation(req); err == nil {
+				t.Fatal("want the write to fail")
+			}
+
+			resp, err := s.FileOperation(&model.FileOperationRequest{Command: "undo_edit", Path: path})
+			if err != nil || resp.Success {
+				t.Errorf("undo_edit after the failed write = %+v, %v; want no history", resp, err)
+			}
+			if lines := readTestLines(t, path); strings.Join(lines, ",") != "one,two" {
+				t.Errorf("file = %q, want it untouched", lines)
+			}
+		})
+	}
+}
+
+func TestStrReplaceRejectsInvalidArguments(t *testing.T) {
+	s, dir := newTestFileService(t)
+	path := filepath.Join(dir, "file.txt")
+	writeTestFile(t, path, []string{"one", "two"})
+
+	for _, req := range []*model.FileOperationRequest{
+		{Command: "str_replace", Path: path, OldStr: "", NewStr: "x"},
+		{Command: "str_replace", Path: path, OldStr: "one", Occurrence: -1},
+		{Command: "str_replace", Path: path, OldStr: "one", ReplaceAll: true, Occurrence: 1},
+	} {
+		_, err := s.FileOperation(req)
+		var serviceErr *Error
+		if !errors.As(err, &serviceErr) || serviceErr.Code != CodeInvalidRequest {
+			t.Errorf("old_str %q, occurrence %d, replace_all %v: error = %v, want %s", req.OldStr, req.Occurrence, req.ReplaceAll, err, CodeInvalidRequest)
+		}
+	}
+
+	if result := replaceString("abc", "", "x", true, 0); result.failure == "" {
+		t.Errorf("replaceString with an empty old string = %+v, want a failure", result)
+	}
+	if got := strings.Join(readTestLines(t, path), ","); got != "one,two" {
+		t.Errorf("file = %q, want it untouched", got)
+	}
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// writeFileAtomic replaces the content of path through a temporary file in
+// the same directory that is synced and renamed over it, so that a crash
+// leaves either the old or the new content. An existing file keeps its mode
+// and, where permitted, its owner; a new file is created with mode 0644.
+// The directory is pinned by the path policy, so a symlink swapped into the
+// path does not redirect the write.
+//
+// Files that cannot be replaced by rename, such as files bind-mounted into a
+// container or files in a directory the agent cannot write to, are
+// overwritten in place instead.
+func (s *FileService) writeFileAtomic(path string, data []byte) error {
+	dir, base, err := s.policy.openParent(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return replaceErrorPath(writeFileAtomicAt(dir, base, data), dirPath(dir), dir.Name())
+}
+
+func writeFileAtomicAt(dir *os.File, base string, data []byte) error {
+	path := pathAt(dir, base)
+	perm := os.FileMode(0644)
+	uid, gid := -1, -1
+	// 末尾的符号链接（follow_symlinks 为 false 时）会被替换为普通文件，沿用其目标的权限
+	info, err := os.Stat(path)
+	switch {
+	case err == nil:
+		if !info.Mode().IsRegular() {
+			return newError(CodeInvalidRequest, "not a regular file: %s", filepath.Join(dir.Name(), base))
+		}
+		perm = info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(st.Uid), int(st.Gid)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dirPath(dir), "."+base+".*.tmp")
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EROFS) {
+			return writeFileInPlace(dir, base, data, perm)
+		}
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil && uid >= 0 && (uid != os.Geteuid() || gid != os.Getegid()) {
+		// 只有 root 才能修改属主，失败时保留 agent 自己的属主
+		if chownErr := tmp.Chown(uid, gid); chownErr == nil {
+			// chown 会清除 setuid/setgid 位
+			err = tmp.Chmod(perm)
+		}
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		if errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EXDEV) {
+			return writeFileInPlace(dir, base, data, perm)
+		}
+		return err
+	}
+	syncDir(dirPath(dir))
+	return nil
+}
+
+// writeFileInPlace truncates and rewrites base inside dir, for files that
+// cannot be replaced atomically
+func writeFileInPlace(dir *os.File, base string, data []byte, perm os.FileMode) error {
+	file, err := openAt(dir, base, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir flushes a directory entry change such as a rename to disk. Errors
+// are ignored, since not every file system supports syncing directories.
+func syncDir(dir string) {
+	if dir == "" {
+		dir = "."
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// lineEnding returns the line ending used by content: "\r\n" when its first
+// line ends with CRLF, "\n" otherwise
+func lineEnding(content string) string {
+	if i := strings.IndexByte(content, '\n'); i > 0 && content[i-1] == '\r' {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// withLineEnding converts the line endings of text to eol, so that text sent
+// with LF line endings can be matched against and inserted into a CRLF file
+func withLineEnding(text, eol string) string {
+	if eol == "\n" {
+		return text
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", eol)
+}
@@ -0,0 +1,74 @@
+//go:build linux
+
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"litterbox-agent/internal/model"
+)
+
+// bindMount mounts source onto target for the duration of the test, skipping
+// it where mounting is not permitted
+func bindMount(t *testing.T, source, target string, readOnly bool) {
+	t.Helper()
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND, ""); err != nil {
+		t.Skipf("cannot bind mount: %v", err)
+	}
+	t.Cleanup(func() { syscall.Unmount(target, syscall.MNT_DETACH) })
+	if readOnly {
+		if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			t.Skipf("cannot remount read-only: %v", err)
+		}
+	}
+}
+
+func TestEditFallsBackToWritingInPlace(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		mount func(t *testing.T, dir, path, source string)
+	}{
+		{
+			// 挂载点上的文件不能被 rename 覆盖（EBUSY/EXDEV）
+			name: "mounted file",
+			mount: func(t *testing.T, dir, path, source string) {
+				bindMount(t, source, path, false)
+			},
+		},
+		{
+			// 目录只读时无法创建临时文件，但挂载进来的文件本身可写
+			name: "read-only directory",
+			mount: func(t *testing.T, dir, path, source string) {
+				bindMount(t, dir, dir, true)
+				bindMount(t, source, path, false)
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, dir := newTestFileService(t)
+			sub := filepath.Join(dir, "sub")
+			if err := os.Mkdir(sub, 0755); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(sub, "mounted.txt")
+			source := filepath.Join(dir, "source.txt")
+			writeTestFile(t, path, nil)
+			writeTestFile(t, source, []string{"one", "two"})
+			tt.mount(t, sub, path, source)
+
+			mustOperate(t, s, &model.FileOperationRequest{Command: "str_replace", Path: path, OldStr: "one", NewStr: "uno"})
+
+			// 写入的是挂载的文件本身
+			if got := strings.Join(readTestLines(t, source), ","); got != "uno,two" {
+				t.Errorf("source file = %q, want it written in place", got)
+			}
+			if leftovers, _ := filepath.Glob(filepath.Join(sub, ".*.tmp")); len(leftovers) != 0 {
+				t.Errorf("temporary files left behind: %v", leftovers)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"litterbox-agent/internal/model"
+)
+
+func TestEditKeepsModeAndOwner(t *testing.T) {
+	s, dir := newTestFileService(t)
+	path := filepath.Join(dir, "run.sh")
+	writeTestFile(t, path, []string{"echo one"})
+	if os.Geteuid() == 0 {
+		if err := os.Chown(path, 65534, 65534); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// chown 会清除 setuid 位，因此在其后设置
+	if err := os.Chmod(path, 0750|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustOperate(t, s, &model.FileOperationRequest{Command: "str_replace", Path: path, OldStr: "one", NewStr: "two"})
+
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Mode() != before.Mode() {
+		t.Errorf("mode after the edit = %v, want %v", after.Mode(), before.Mode())
+	}
+	was, is := before.Sys().(*syscall.Stat_t), after.Sys().(*syscall.Stat_t)
+	if is.Uid != was.Uid || is.Gid != was.Gid {
+		t.Errorf("owner after the edit = %d:%d, want %d:%d", is.Uid, is.Gid, was.Uid, was.Gid)
+	}
+}
+
+func TestEditKeepsCRLF(t *testing.T) {
+	s, dir := newTestFileService(t)
+	path := filepath.Join(dir, "dos.txt")
+	if err := os.WriteFile(path, []byte("one\r\ntwo\r\nthree\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mustOperate(t, s, &model.FileOperationRequest{Command: "str_replace", Path: path, OldStr: "one\ntwo", NewStr: "uno\ndos"})
+	mustOperate(t, s, &model.FileOperationRequest{Command: "insert", Path: path, InsertLine: 3, NewStr: "four\nfive"})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "uno\r\ndos\r\nthree\r\nfour\r\nfive\r\n"; string(data) != want {
+		t.Errorf("file = %q, want %q", data, want)
+	}
+}
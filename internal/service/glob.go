@@ -0,0 +1,84 @@
+package service
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// globFilter selects the entries of a directory walk by include and exclude
+// globs
+type globFilter struct {
+	root    string // 相对路径的基准目录
+	include []string
+	exclude []string
+}
+
+// included reports whether path passes the include globs
+func (f *globFilter) included(path string) bool {
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		if f.match(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether path matches an exclude glob
+func (f *globFilter) excluded(path string) bool {
+	for _, pattern := range f.exclude {
+		if f.match(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// match matches a glob against path. Patterns containing a slash are matched
+// against the path relative to the walk root, others against the file name.
+func (f *globFilter) match(pattern, path string) bool {
+	if !strings.Contains(pattern, "/") {
+		return globMatch(pattern, filepath.Base(path))
+	}
+	rel, err := filepath.Rel(f.root, path)
+	if err != nil {
+		return false
+	}
+	return globMatch(strings.TrimPrefix(pattern, "/"), filepath.ToSlash(rel))
+}
+
+// globMatch reports whether name matches a slash-separated glob pattern. In
+// addition to the syntax of path.Match, a "**" segment matches any number of
+// path segments, including none.
+func globMatch(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			if len(rest) == 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(rest, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
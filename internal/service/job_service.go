@@ -0,0 +1,313 @@
+package service
+
+import (
+	"context"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+
+	"litterbox-agent/internal/config"
+	"litterbox-agent/internal/model"
+)
+
+const (
+	JobStatusRunning  = "running"
+	JobStatusExited   = "exited"
+	JobStatusKilled   = "killed"
+	JobStatusTimedOut = "timed_out"
+	JobStatusFailed   = "failed"
+)
+
+type JobService struct {
+	execService *ExecService
+	cfg         config.JobConfig
+
+	mu   sync.RWMutex
+	jobs map[string]*job
+}
+
+// job is a command running in the background, detached from any HTTP request
+type job struct {
+	id      string
+	command string
+	argv    []string
+	cmd     *exec.Cmd
+	stdout  *ringBuffer
+	stderr  *ringBuffer
+
+	mu         sync.Mutex
+	status     string
+	exitCode   int
+	timedOut   bool
+	killed     bool
+	err        string
+	startedAt  time.Time
+	finishedAt time.Time
+	usage      resourceUsage
+	limitMode  string
+	applied    *model.ResourceLimits // 实际生效的资源限制
+}
+
+func NewJobService(execService *ExecService, cfg config.JobConfig) *JobService {
+	s := &JobService{
+		execService: execService,
+		cfg:         cfg,
+		jobs:        make(map[string]*job),
+	}
+	go s.reapLoop()
+	return s
+}
+
+// StartJob starts a command in the background and returns immediately
+func (s *JobService) StartJob(req *model.CommandRequest) (*model.JobInfo, error) {
+	cmd, rg, err := s.execService.buildCommand(req)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &job{
+		id:      "job-" + uuid.New().String(),
+		command: req.Command,
+		argv:    req.Argv,
+		cmd:     cmd,
+		stdout:  newRingBuffer(s.cfg.OutputBufferBytes),
+		stderr:  newRingBuffer(s.cfg.OutputBufferBytes),
+		status:  JobStatusRunning,
+	}
+	cmd.Stdout = j.stdout
+	cmd.Stderr = j.stderr
+
+	// 后台任务默认不设超时，只有显式指定 timeout_ms 时才生效
+	var timeout time.Duration
+	if req.TimeoutMs > 0 {
+		timeout = s.execService.timeout(req.TimeoutMs)
+	}
+
+	j.startedAt = time.Now()
+	cmd, err = s.execService.start(cmd, rg, timeout)
+	if err != nil {
+		return nil, err
+	}
+	j.cmd = cmd
+	j.limitMode = rg.mode()
+	j.applied = rg.appliedLimits()
+
+	s.mu.Lock()
+	s.jobs[j.id] = j
+	s.mu.Unlock()
+
+	go func() {
+		result := s.execService.wait(context.Background(), cmd, rg, j.startedAt, timeout)
+		j.finish(result)
+	}()
+
+	return j.info(false), nil
+}
+
+// GetJob returns the status and buffered output of a job
+func (s *JobService) GetJob(id string) (*model.JobInfo, error) {
+	j, err := s.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	return j.info(true), nil
+}
+
+// ListJobs returns all known jobs ordered by start time, without their output
+func (s *JobService) ListJobs() []*model.JobInfo {
+	s.mu.RLock()
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(jobs, func(a, b int) bool {
+		return jobs[a].startedAt.Before(jobs[b].startedAt)
+	})
+
+	infos := make([]*model.JobInfo, 0, len(jobs))
+	for _, j := range jobs {
+		infos = append(infos, j.info(false))
+	}
+	return infos
+}
+
+// KillJob sends a signal (SIGTERM by default) to the process group of a job
+func (s *JobService) KillJob(id, signal string) (*model.JobInfo, error) {
+	j, err := s.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := parseSignal(signal)
+	if err != nil {
+		return nil, err
+	}
+
+	j.mu.Lock()
+	if j.status == JobStatusRunning {
+		// 命令本身已经退出时，信号只送到残留的后台进程，任务不算被终止
+		alive := !processExited(j.cmd.Process)
+		err := signalGroup(j.cmd, sig)
+		if err != nil && err != syscall.ESRCH {
+			j.mu.Unlock()
+			return nil, err
+		}
+		if err == nil && alive {
+			j.killed = true
+		}
+	}
+	j.mu.Unlock()
+
+	return j.info(false), nil
+}
+
+func (s *JobService) lookup(id string) (*job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, newError(CodeNotFound, "job not found: %s", id)
+	}
+	return j, nil
+}
+
+// reapLoop periodically removes finished jobs older than the retention time
+func (s *JobService) reapLoop() {
+	interval := s.cfg.Retention / 2
+	if interval <= 0 || interval > time.Minute {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.reap(time.Now())
+	}
+}
+
+func (s *JobService) reap(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, j := range s.jobs {
+		j.mu.Lock()
+		expired := j.status != JobStatusRunning && now.Sub(j.finishedAt) > s.cfg.Retention
+		j.mu.Unlock()
+
+		if expired {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+func (j *job) finish(result runResult) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.exitCode = result.exitCode
+	j.timedOut = result.timedOut
+	j.finishedAt = time.Now()
+	j.usage = result.usage
+
+	switch {
+	case result.err != nil:
+		j.status = JobStatusFailed
+		j.err = result.err.Error()
+	case result.timedOut:
+		j.status = JobStatusTimedOut
+	case j.killed:
+		j.status = JobStatusKilled
+	default:
+		j.status = JobStatusExited
+	}
+}
+
+// info builds the API representation of a job, optionally with its output
+func (j *job) info(withOutput bool) *model.JobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	info := &model.JobInfo{
+		ID:            j.id,
+		Command:       j.command,
+		Argv:          j.argv,
+		Status:        j.status,
+		Error:         j.err,
+		StartedAt:     j.startedAt,
+		LimitMode:     j.limitMode,
+		AppliedLimits: j.applied,
+	}
+	if j.cmd.Process != nil {
+		info.Pid = j.cmd.Process.Pid
+	}
+
+	if j.status == JobStatusRunning {
+		info.DurationMs = time.Since(j.startedAt).Milliseconds()
+	} else {
+		exitCode := j.exitCode
+		finishedAt := j.finishedAt
+		info.ExitCode = &exitCode
+		info.TimedOut = j.timedOut
+		info.FinishedAt = &finishedAt
+		info.DurationMs = finishedAt.Sub(j.startedAt).Milliseconds()
+		info.PeakMemoryBytes = j.usage.peakMemoryBytes
+		info.CPUTimeMs = j.usage.cpuTime.Milliseconds()
+	}
+
+	if withOutput {
+		info.Stdout = string(j.stdout.Bytes())
+		info.Stderr = string(j.stderr.Bytes())
+		info.StdoutDropped = j.stdout.Dropped()
+		info.StderrDropped = j.stderr.Dropped()
+	}
+
+	return info
+}
+
+// parseSignal converts a signal name ("TERM", "SIGKILL") or number into a
+// signal. Numbers are limited to the standard signals 1 to 31.
+func parseSignal(name string) (syscall.Signal, error) {
+	if name == "" {
+		return syscall.SIGTERM, nil
+	}
+
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < 1 || n > 31 {
+			return 0, newError(CodeInvalidRequest, "unsupported signal: %s", name)
+		}
+		return syscall.Signal(n), nil
+	}
+
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "TERM":
+		return syscall.SIGTERM, nil
+	case "KILL":
+		return syscall.SIGKILL, nil
+	case "INT":
+		return syscall.SIGINT, nil
+	case "HUP":
+		return syscall.SIGHUP, nil
+	case "QUIT":
+		return syscall.SIGQUIT, nil
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	case "STOP":
+		return syscall.SIGSTOP, nil
+	case "CONT":
+		return syscall.SIGCONT, nil
+	}
+
+	return 0, newError(CodeInvalidRequest, "unsupported signal: %s", name)
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"litterbox-agent/internal/config"
+	"litterbox-agent/internal/model"
+)
+
+func TestParseSignal(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want syscall.Signal
+	}{
+		{"", syscall.SIGTERM},
+		{"KILL", syscall.SIGKILL},
+		{"sigint", syscall.SIGINT},
+		{"9", syscall.SIGKILL},
+		{"31", syscall.Signal(31)},
+	} {
+		if got, err := parseSignal(tt.name); err != nil || got != tt.want {
+			t.Errorf("parseSignal(%q) = %v, %v; want %v", tt.name, got, err, tt.want)
+		}
+	}
+
+	for _, name := range []string{"0", "-1", "32", "999", "BOGUS"} {
+		_, err := parseSignal(name)
+		var coded *Error
+		if !errors.As(err, &coded) || coded.Code != CodeInvalidRequest {
+			t.Errorf("parseSignal(%q) error = %v, want %s", name, err, CodeInvalidRequest)
+		}
+	}
+}
+
+func TestKillJob(t *testing.T) {
+	s := NewJobService(newTestExecService(), config.JobConfig{OutputBufferBytes: 1 << 10, Retention: time.Hour})
+
+	// 等待任务结束，返回其最终状态
+	wait := func(id string) *model.JobInfo {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			info, err := s.GetJob(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Status != JobStatusRunning {
+				return info
+			}
+		}
+		t.Fatalf("job %s did not finish", id)
+		return nil
+	}
+
+	running, err := s.StartJob(&model.CommandRequest{Command: "sleep 10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.KillJob(running.ID, "TERM"); err != nil {
+		t.Fatal(err)
+	}
+	if info := wait(running.ID); info.Status != JobStatusKilled {
+		t.Errorf("status after killing a running job = %q, want %q", info.Status, JobStatusKilled)
+	}
+
+	exited, err := s.StartJob(&model.CommandRequest{Command: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait(exited.ID)
+	info, err := s.KillJob(exited.ID, "KILL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status != JobStatusExited {
+		t.Errorf("status after signalling an exited job = %q, want %q", info.Status, JobStatusExited)
+	}
+}
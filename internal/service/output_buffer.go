@@ -0,0 +1,79 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+)
+
+// outputBuffer is a bounded writer that keeps the first headLimit bytes and
+// the last tailLimit bytes written to it, dropping everything in between
+type outputBuffer struct {
+	mu        sync.Mutex
+	head      []byte
+	headLimit int
+	tail      *ringBuffer
+	total     int64
+}
+
+func newOutputBuffer(headLimit, tailLimit int) *outputBuffer {
+	return &outputBuffer{
+		headLimit: headLimit,
+		tail:      newRingBuffer(tailLimit),
+	}
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(p)
+	b.total += int64(n)
+
+	if free := b.headLimit - len(b.head); free > 0 {
+		if free > len(p) {
+			free = len(p)
+		}
+		b.head = append(b.head, p[:free]...)
+		p = p[free:]
+	}
+
+	if len(p) > 0 {
+		b.tail.Write(p)
+	}
+	return n, nil
+}
+
+// String returns the retained output. When bytes were dropped, a marker with
+// the number of dropped bytes separates the head from the tail.
+func (b *outputBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tail := b.tail.Bytes()
+	if dropped := b.tail.Dropped(); dropped > 0 {
+		return fmt.Sprintf("%s\n... [%d bytes truncated] ...\n%s", b.head, dropped, tail)
+	}
+	return string(b.head) + string(tail)
+}
+
+// Truncated reports whether any output was dropped
+func (b *outputBuffer) Truncated() bool {
+	return b.tail.Dropped() > 0
+}
+
+// Total returns the number of bytes written, including dropped ones
+func (b *outputBuffer) Total() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total
+}
+
+// Reset discards all output
+func (b *outputBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.head = b.head[:0]
+	b.tail = newRingBuffer(b.tail.size)
+	b.total = 0
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// The functions below act on canonical paths returned by the PathPolicy.
+// Instead of handing the path to the kernel as text, which would follow a
+// symlink swapped into it after it was checked, they pin its directories
+// with openDir and act relative to the parent directory.
+
+// openParent opens the directory containing the canonical path resolved and
+// returns it together with the last component of resolved
+func (p *PathPolicy) openParent(resolved string) (*os.File, string, error) {
+	dir, err := p.openDir(filepath.Dir(resolved), false)
+	if err != nil {
+		return nil, "", err
+	}
+	return dir, filepath.Base(resolved), nil
+}
+
+// openFile opens the canonical path resolved like os.OpenFile, failing
+// instead of following a symlink anywhere in the path
+func (p *PathPolicy) openFile(resolved string, flag int, perm os.FileMode) (*os.File, error) {
+	if resolved == "/" {
+		return os.OpenFile(resolved, flag, perm)
+	}
+	dir, name, err := p.openParent(resolved)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return openAt(dir, name, flag, perm)
+}
+
+// readFile reads the file at the canonical path resolved like openRead
+func (p *PathPolicy) readFile(resolved string) ([]byte, error) {
+	file, err := p.openRead(resolved)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// openRead opens the file at the canonical path resolved for reading. A
+// symlink in its last component, as left by resolveNoFollow, is resolved and
+// checked again and its target opened the same way.
+func (p *PathPolicy) openRead(resolved string) (*os.File, error) {
+	file, err := p.openFile(resolved, os.O_RDONLY, 0)
+	if errors.Is(err, syscall.ELOOP) {
+		target, resolveErr := p.resolve(resolved)
+		if resolveErr != nil {
+			return nil, resolveErr
+		}
+		file, err = p.openFile(target, os.O_RDONLY, 0)
+	}
+	return file, err
+}
+
+// mkdirAll creates the canonical directory resolved together with any
+// missing parents, like os.MkdirAll
+func (p *PathPolicy) mkdirAll(resolved string) error {
+	dir, err := p.openDir(resolved, true)
+	if err != nil {
+		return err
+	}
+	return dir.Close()
+}
+
+// at calls fn with a path to the canonical path resolved whose directories
+// are reached through the pinned parent directory. fn must not follow a
+// symlink in the last component, as os.Lstat, os.Remove or os.Symlink do.
+func (p *PathPolicy) at(resolved string, fn func(path string) error) error {
+	dir, name, err := p.openParent(resolved)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return replaceErrorPath(fn(pathAt(dir, name)), dirPath(dir), dir.Name())
+}
+
+// pathAt returns a path to name inside dir that does not depend on the path
+// of dir
+func pathAt(dir *os.File, name string) string {
+	return filepath.Join(dirPath(dir), name)
+}
+
+// chmod changes the mode of the canonical path resolved without following a
+// symlink
+func (p *PathPolicy) chmod(resolved string, mode os.FileMode) error {
+	dir, name, err := p.openParent(resolved)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return chmodAt(dir, name, mode)
+}
+
+// rename renames the canonical path src to dst like os.Rename
+func (p *PathPolicy) rename(src, dst string) error {
+	return p.at(src, func(srcAt string) error {
+		return p.at(dst, func(dstAt string) error {
+			return os.Rename(srcAt, dstAt)
+		})
+	})
+}
+
+// replaceErrorPath rewrites the paths in err that lie inside from to lie
+// inside to, so that errors name the directory the client asked for rather
+// than its descriptor path
+func replaceErrorPath(err error, from, to string) error {
+	replace := func(path string) string {
+		if within(path, from) {
+			return to + strings.TrimPrefix(path, from)
+		}
+		return path
+	}
+
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.As(err, &pathErr):
+		pathErr.Path = replace(pathErr.Path)
+	case errors.As(err, &linkErr):
+		linkErr.Old = replace(linkErr.Old)
+		linkErr.New = replace(linkErr.New)
+	}
+	return err
+}
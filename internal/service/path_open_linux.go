@@ -0,0 +1,116 @@
+//go:build linux
+
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// oPath is O_PATH, which package syscall does not define: the descriptor
+// only pins a location in the file system and needs no permission to read it
+const oPath = 0x200000
+
+// openDir opens the canonical directory dir one component at a time with
+// O_NOFOLLOW, starting from the held workspace root when dir lies inside it.
+// A symlink swapped into the path after it was resolved makes the open fail
+// instead of leading somewhere else. With create, missing directories are
+// created with mode 0755 like os.MkdirAll does.
+func (p *PathPolicy) openDir(dir string, create bool) (*os.File, error) {
+	current, rel := "/", strings.TrimPrefix(dir, "/")
+	var fd int
+	var err error
+	if p.rootDir != nil && within(dir, p.root) {
+		current, rel = p.root, strings.TrimPrefix(strings.TrimPrefix(dir, p.root), "/")
+		fd, err = syscall.Openat(int(p.rootDir.Fd()), ".", oPath|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	} else {
+		fd, err = syscall.Open(current, oPath|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: current, Err: err}
+	}
+
+	for _, name := range strings.Split(rel, "/") {
+		if name == "" {
+			continue
+		}
+		current = filepath.Join(current, name)
+
+		next, err := openDirAt(fd, name)
+		if errors.Is(err, syscall.ENOENT) && create {
+			err = syscall.Mkdirat(fd, name, 0755)
+			if err == nil || errors.Is(err, syscall.EEXIST) {
+				next, err = openDirAt(fd, name)
+			}
+		}
+		syscall.Close(fd)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: current, Err: err}
+		}
+		fd = next
+	}
+	return os.NewFile(uintptr(fd), dir), nil
+}
+
+// openDirAt opens the directory name inside dirfd, failing with ELOOP rather
+// than ENOTDIR when name is a symlink
+func openDirAt(dirfd int, name string) (int, error) {
+	fd, err := syscall.Openat(dirfd, name, oPath|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if errors.Is(err, syscall.ENOTDIR) {
+		if link, linkErr := syscall.Openat(dirfd, name, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0); linkErr == nil {
+			var st syscall.Stat_t
+			if syscall.Fstat(link, &st) == nil && st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+				err = syscall.ELOOP
+			}
+			syscall.Close(link)
+		}
+	}
+	return fd, err
+}
+
+// openAt opens name inside dir like os.OpenFile, failing with ELOOP if name
+// is a symlink
+func openAt(dir *os.File, name string, flag int, perm os.FileMode) (*os.File, error) {
+	fd, err := syscall.Openat(int(dir.Fd()), name, flag|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, syscallMode(perm))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: filepath.Join(dir.Name(), name), Err: err}
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(dir.Name(), name)), nil
+}
+
+// dirPath returns a path that reaches dir through its open descriptor
+// rather than by name, for the functions of package os that have no *at form
+func dirPath(dir *os.File) string {
+	return "/proc/self/fd/" + strconv.Itoa(int(dir.Fd()))
+}
+
+// chmodAt changes the mode of name inside dir without following a symlink.
+// Linux has no fchmodat flag for that, so the file is pinned with O_PATH and
+// changed through its descriptor.
+func chmodAt(dir *os.File, name string, mode os.FileMode) error {
+	file, err := openAt(dir, name, oPath, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return os.Chmod(dirPath(file), mode)
+}
+
+// syscallMode converts a file mode to the bits expected by open(2)
+func syscallMode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= syscall.S_ISVTX
+	}
+	return bits
+}
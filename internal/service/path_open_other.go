@@ -0,0 +1,44 @@
+//go:build !linux
+
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// openDir opens the canonical directory dir. Without O_PATH and /proc the
+// directories are looked up by name, so only the last component of a path
+// is protected against symlinks swapped in after it was resolved.
+func (p *PathPolicy) openDir(dir string, create bool) (*os.File, error) {
+	if create {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return os.Open(dir)
+}
+
+// openAt opens name inside dir like os.OpenFile, failing if name is a symlink
+func openAt(dir *os.File, name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(filepath.Join(dir.Name(), name), flag|syscall.O_NOFOLLOW, perm)
+}
+
+// dirPath returns the path of dir
+func dirPath(dir *os.File) string {
+	return dir.Name()
+}
+
+// chmodAt changes the mode of name inside dir, refusing to follow a symlink
+func chmodAt(dir *os.File, name string, mode os.FileMode) error {
+	path := pathAt(dir, name)
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return &os.PathError{Op: "chmod", Path: path, Err: syscall.ELOOP}
+	}
+	return os.Chmod(path, mode)
+}
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"litterbox-agent/internal/config"
+)
+
+// maxSymlinkHops limits how many symlinks are followed while resolving a path
+const maxSymlinkHops = 255
+
+// PathPolicy decides which paths the file endpoints may access. A path is
+// accessible when it lies inside the workspace root or one of the allowed
+// directories, and not inside a denied path. Paths are checked after all
+// symlinks have been resolved, so a link cannot be used to escape, and then
+// opened without following symlinks (see openDir), so neither can a link
+// swapped in after the check.
+type PathPolicy struct {
+	root  string
+	allow []string
+	deny  []string
+
+	rootDir *os.File // 工作区根目录的句柄，路径在其下逐级打开
+}
+
+// NewPathPolicy creates a path policy from the workspace settings. The root
+// must be an existing directory.
+func NewPathPolicy(cfg config.WorkspaceConfig) (*PathPolicy, error) {
+	root := cfg.Root
+	if root == "" {
+		root = "/"
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid workspace root: %w", err)
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("workspace root is not a directory: %s", root)
+	}
+
+	p := &PathPolicy{root: root}
+	for _, path := range cfg.Allow {
+		resolved, err := p.canonical(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed path %s: %w", path, err)
+		}
+		p.allow = append(p.allow, resolved)
+	}
+	for _, path := range cfg.Deny {
+		resolved, err := p.canonical(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied path %s: %w", path, err)
+		}
+		p.deny = append(p.deny, resolved)
+	}
+
+	if p.rootDir, err = os.Open(root); err != nil {
+		return nil, fmt.Errorf("invalid workspace root: %w", err)
+	}
+	return p, nil
+}
+
+// Root returns the canonical workspace root
+func (p *PathPolicy) Root() string {
+	return p.root
+}
+
+// resolve returns the canonical form of path with every symlink resolved,
+// failing if the result is not accessible. Relative paths are resolved
+// against the workspace root.
+func (p *PathPolicy) resolve(path string) (string, error) {
+	if path == "" {
+		return "", newError(CodeInvalidRequest, "path required")
+	}
+
+	resolved, err := p.canonical(path)
+	if err != nil {
+		return "", newError(CodeInvalidRequest, "cannot resolve path %s: %v", path, err)
+	}
+	if err := p.check(path, resolved); err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// resolveNoFollow is like resolve, but leaves a symlink in the last component
+// unresolved, for operations that act on the link itself
+func (p *PathPolicy) resolveNoFollow(path string) (string, error) {
+	if path == "" {
+		return "", newError(CodeInvalidRequest, "path required")
+	}
+
+	dir, err := p.canonical(filepath.Dir(p.abs(path)))
+	if err != nil {
+		return "", newError(CodeInvalidRequest, "cannot resolve path %s: %v", path, err)
+	}
+	resolved := filepath.Join(dir, filepath.Base(p.abs(path)))
+	if err := p.check(path, resolved); err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// checkTree is like check, but also fails when a denied path lies inside
+// resolved, for operations that act on a whole directory tree
+func (p *PathPolicy) checkTree(path, resolved string) error {
+	if err := p.check(path, resolved); err != nil {
+		return err
+	}
+	for _, denied := range p.deny {
+		if within(denied, resolved) {
+			return newError(CodePathNotAllowed, "%s contains %s, which is not allowed", path, denied)
+		}
+	}
+	return nil
+}
+
+// check reports whether the canonical path resolved from path is accessible
+func (p *PathPolicy) check(path, resolved string) error {
+	for _, denied := range p.deny {
+		if within(resolved, denied) {
+			return newError(CodePathNotAllowed, "access to %s is not allowed", path)
+		}
+	}
+
+	if within(resolved, p.root) {
+		return nil
+	}
+	for _, allowed := range p.allow {
+		if within(resolved, allowed) {
+			return nil
+		}
+	}
+	return newError(CodePathOutsideWorkspace, "path is outside the workspace: %s", path)
+}
+
+// abs makes path absolute relative to the workspace root
+func (p *PathPolicy) abs(path string) string {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(p.root, path)
+	}
+	return filepath.Clean(path)
+}
+
+// canonical resolves every symlink in path. Unlike filepath.EvalSymlinks,
+// trailing components that do not exist yet are kept as they are, so that
+// paths of files about to be created can be checked as well. Dangling
+// symlinks are followed to their target. A ".." after a missing component,
+// which can only come from a symlink target, fails like it does in the
+// kernel.
+func (p *PathPolicy) canonical(path string) (string, error) {
+	resolved := string(filepath.Separator)
+	pending := splitPath(p.abs(path))
+	hops := 0
+
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, name)
+		info, err := os.Lstat(next)
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			// 其余部分尚不存在，不可能再包含符号链接。但来自链接目标的 ..
+			// 会回到已存在的目录，按文本拼接会跳过其中的符号链接，内核也不会
+			// 解析经过不存在目录的 ..，因此直接拒绝
+			for _, rest := range pending {
+				if rest == ".." {
+					return "", err
+				}
+			}
+			return filepath.Join(append([]string{next}, pending...)...), nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", syscall.ELOOP
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = string(filepath.Separator)
+		}
+		pending = append(splitPath(target), pending...)
+	}
+
+	return resolved, nil
+}
+
+func splitPath(path string) []string {
+	return strings.Split(path, string(filepath.Separator))
+}
+
+// within reports whether path is dir or lies inside it; both must be clean
+func within(path, dir string) bool {
+	if dir == string(filepath.Separator) || path == dir {
+		return true
+	}
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"litterbox-agent/internal/config"
+)
+
+// newTestPolicy creates a workspace with a directory outside of it, and a
+// policy rooted at the workspace
+func newTestPolicy(t *testing.T) (policy *PathPolicy, ws, outside string) {
+	t.Helper()
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws = filepath.Join(dir, "ws")
+	outside = filepath.Join(dir, "outside")
+	for _, d := range []string{ws, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err = NewPathPolicy(config.WorkspaceConfig{Root: ws})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy, ws, outside
+}
+
+func TestResolveRejectsDotDotAfterMissingComponent(t *testing.T) {
+	policy, ws, outside := newTestPolicy(t)
+
+	// link -> nonexist/../evil 在文本上等于 evil，而 evil 指向工作区之外
+	if err := os.Symlink(outside, filepath.Join(ws, "evil")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("nonexist/../evil", filepath.Join(ws, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"link/secret", filepath.Join(ws, "link", "secret"), "evil/secret"} {
+		resolved, err := policy.resolve(path)
+		if err == nil {
+			t.Errorf("resolve(%q) = %q, want an error", path, resolved)
+		}
+	}
+}
+
+func TestResolveMissingPath(t *testing.T) {
+	policy, ws, _ := newTestPolicy(t)
+
+	if err := os.Symlink("sub", filepath.Join(ws, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"new/dir/file.txt":  filepath.Join(ws, "new", "dir", "file.txt"),
+		"dangling/file.txt": filepath.Join(ws, "sub", "file.txt"),
+		"new/../file.txt":   filepath.Join(ws, "file.txt"),
+	}
+	for path, want := range tests {
+		resolved, err := policy.resolve(path)
+		if err != nil {
+			t.Errorf("resolve(%q): %v", path, err)
+		} else if resolved != want {
+			t.Errorf("resolve(%q) = %q, want %q", path, resolved, want)
+		}
+	}
+}
+
+func TestResolveOutsideWorkspace(t *testing.T) {
+	policy, ws, outside := newTestPolicy(t)
+
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(ws, "secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"secret", "../outside/secret", filepath.Join(outside, "secret")} {
+		_, err := policy.resolve(path)
+		var serviceErr *Error
+		if !errors.As(err, &serviceErr) || serviceErr.Code != CodePathOutsideWorkspace {
+			t.Errorf("resolve(%q) error = %v, want %s", path, err, CodePathOutsideWorkspace)
+		}
+	}
+}
+
+func TestSymlinkSwappedInAfterResolve(t *testing.T) {
+	policy, ws, outside := newTestPolicy(t)
+	s := NewFileService(policy)
+
+	dir := filepath.Join(ws, "dir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := policy.resolve("dir/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := policy.resolve("dir/sub/created")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 检查之后、使用之前，dir 被替换为指向工作区外的符号链接
+	if err := os.Rename(dir, filepath.Join(ws, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := policy.readFile(secret); err == nil {
+		t.Errorf("readFile read %q through the symlink", data)
+	}
+	if file, err := policy.openFile(secret, os.O_RDONLY, 0); err == nil {
+		file.Close()
+		t.Error("openFile opened a file through the symlink")
+	}
+	if err := s.writeFileAtomic(secret, []byte("overwritten")); err == nil {
+		t.Error("writeFileAtomic wrote through the symlink")
+	}
+	if err := policy.mkdirAll(filepath.Dir(created)); err == nil {
+		t.Error("mkdirAll created a directory through the symlink")
+	}
+	if err := policy.chmod(secret, 0600); err == nil {
+		t.Error("chmod changed a file through the symlink")
+	}
+	if err := policy.at(secret, os.Remove); err == nil {
+		t.Error("remove deleted a file through the symlink")
+	}
+	if infos, err := policy.readDir(filepath.Dir(secret)); err == nil {
+		t.Errorf("readDir listed %d entries through the symlink", len(infos))
+	}
+
+	data, err := os.ReadFile(filepath.Join(outside, "secret"))
+	if err != nil || string(data) != "secret" {
+		t.Errorf("file outside the workspace changed: %q, %v", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(outside, "secret")); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("mode of the file outside the workspace changed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "sub")); err == nil {
+		t.Error("directory created outside the workspace")
+	}
+}
+
+func TestWalkDirectorySwappedDuringWalk(t *testing.T) {
+	policy, ws, outside := newTestPolicy(t)
+	if err := os.MkdirAll(filepath.Join(ws, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var visited []string
+	err := policy.walk(ws, walkOptions{}, func(path string, info os.FileInfo, depth int) error {
+		visited = append(visited, path)
+		if filepath.Base(path) == "dir" {
+			// 报告目录之后、进入目录之前，将其替换为指向工作区外的符号链接
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			return os.Symlink(outside, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range visited {
+		if filepath.Base(path) == "secret" {
+			t.Errorf("walk visited %s through the swapped-in symlink", path)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+
+	"litterbox-agent/internal/config"
+)
+
+type PtyService struct {
+	execService *ExecService
+	cfg         config.PtyConfig
+}
+
+func NewPtyService(execService *ExecService, cfg config.PtyConfig) *PtyService {
+	return &PtyService{
+		execService: execService,
+		cfg:         cfg,
+	}
+}
+
+// PtySession is a login shell attached to a pseudo-terminal
+type PtySession struct {
+	cmd       *exec.Cmd
+	pty       *os.File
+	killGrace time.Duration
+
+	done     chan struct{}
+	exitCode int
+	once     sync.Once
+}
+
+// StartSession starts a login shell on a new pseudo-terminal with the given
+// size, running as userSpec (or the configured default user) when set
+func (s *PtyService) StartSession(rows, cols uint16, userSpec string) (*PtySession, error) {
+	cmd := exec.Command(s.shell(), "-l")
+
+	u, err := s.execService.resolveUser(userSpec, "")
+	if err != nil {
+		return nil, err
+	}
+
+	env := map[string]string{"TERM": "xterm-256color"}
+	home, _ := os.UserHomeDir()
+	if u != nil {
+		u.apply(cmd)
+		env = u.env(env)
+		home = u.home
+	}
+	cmd.Env = mergeEnv(os.Environ(), env)
+
+	// 在用户主目录中启动（如果存在）
+	if info, err := os.Stat(home); err == nil && info.IsDir() {
+		cmd.Dir = home
+	}
+
+	// pty.Start 会让 shell 成为新会话的首进程，因此其 pid 即进程组 ID
+	f, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: rows, Cols: cols})
+	if err != nil {
+		return nil, err
+	}
+
+	session := &PtySession{
+		cmd:       cmd,
+		pty:       f,
+		killGrace: s.execService.cfg.KillGrace,
+		done:      make(chan struct{}),
+	}
+
+	go func() {
+		exitCode := 0
+		if err := cmd.Wait(); err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				exitCode = exitErr.ExitCode()
+			} else {
+				exitCode = 127
+			}
+		}
+		session.exitCode = exitCode
+		close(session.done)
+	}()
+
+	return session, nil
+}
+
+// OriginAllowed reports whether a browser page from origin may open a
+// terminal, besides pages served from the agent itself
+func (s *PtyService) OriginAllowed(origin string) bool {
+	for _, allowed := range s.cfg.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// shell returns the configured shell, or the first available default
+func (s *PtyService) shell() string {
+	if s.cfg.Shell != "" {
+		return s.cfg.Shell
+	}
+	for _, shell := range []string{"/bin/bash", "/bin/sh"} {
+		if _, err := os.Stat(shell); err == nil {
+			return shell
+		}
+	}
+	return "sh"
+}
+
+// Read reads terminal output
+func (p *PtySession) Read(b []byte) (int, error) {
+	return p.pty.Read(b)
+}
+
+// Write sends keystrokes to the terminal
+func (p *PtySession) Write(b []byte) (int, error) {
+	return p.pty.Write(b)
+}
+
+// Resize changes the terminal window size
+func (p *PtySession) Resize(rows, cols uint16) error {
+	return pty.Setsize(p.pty, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
+// Done is closed once the shell has exited
+func (p *PtySession) Done() <-chan struct{} {
+	return p.done
+}
+
+// ExitCode returns the shell exit code; only valid after Done is closed
+func (p *PtySession) ExitCode() int {
+	return p.exitCode
+}
+
+// Close hangs up the terminal, killing the shell and its children if they do
+// not exit within the grace period. It is safe to call more than once.
+func (p *PtySession) Close() {
+	p.once.Do(func() {
+		signalGroup(p.cmd, syscall.SIGHUP)
+
+		select {
+		case <-p.done:
+		case <-time.After(p.killGrace):
+			signalGroup(p.cmd, syscall.SIGKILL)
+			<-p.done
+		}
+
+		p.pty.Close()
+	})
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"os"
+	"time"
+
+	"litterbox-agent/internal/model"
+)
+
+const (
+	LimitModeCgroup = "cgroup"
+	LimitModeRlimit = "rlimit"
+)
+
+// resourceLimits are the effective limits of one command
+type resourceLimits struct {
+	cpus        float64
+	memoryBytes int64
+	pids        int64
+
+	requested model.ResourceLimits // 请求中显式指定的限制，无法生效时返回错误
+}
+
+func (l resourceLimits) empty() bool {
+	return l.cpus <= 0 && l.memoryBytes <= 0 && l.pids <= 0
+}
+
+// model converts the limits to their API representation, or nil when none
+// are set
+func (l resourceLimits) model() *model.ResourceLimits {
+	if l.empty() {
+		return nil
+	}
+	return &model.ResourceLimits{CPUs: l.cpus, MemoryBytes: l.memoryBytes, Pids: l.pids}
+}
+
+// resourceUsage is the resource consumption of a finished command
+type resourceUsage struct {
+	peakMemoryBytes int64
+	cpuTime         time.Duration
+}
+
+// effectiveLimits merges the limits of a request with the agent defaults;
+// each limit set in the request overrides the corresponding default
+func (s *ExecService) effectiveLimits(req *model.ResourceLimits) (resourceLimits, error) {
+	limits := resourceLimits{
+		cpus:        s.cfg.DefaultCPUs,
+		memoryBytes: s.cfg.DefaultMemoryBytes,
+		pids:        s.cfg.DefaultPids,
+	}
+	if req == nil {
+		return limits, nil
+	}
+
+	if req.CPUs < 0 || req.MemoryBytes < 0 || req.Pids < 0 {
+		return limits, newError(CodeInvalidRequest, "resource limits must not be negative")
+	}
+	limits.requested = *req
+	if req.CPUs > 0 {
+		limits.cpus = req.CPUs
+	}
+	if req.MemoryBytes > 0 {
+		limits.memoryBytes = req.MemoryBytes
+	}
+	if req.Pids > 0 {
+		limits.pids = req.Pids
+	}
+	return limits, nil
+}
+
+// rusageOf returns the resource usage recorded by the kernel for a reaped
+// process and the descendants it waited for
+func rusageOf(state *os.ProcessState) resourceUsage {
+	if state == nil {
+		return resourceUsage{}
+	}
+	return resourceUsage{
+		peakMemoryBytes: maxRSSBytes(state),
+		cpuTime:         state.UserTime() + state.SystemTime(),
+	}
+}
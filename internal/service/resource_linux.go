@@ -0,0 +1,574 @@
+//go:build linux
+
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/uuid"
+
+	"litterbox-agent/internal/model"
+)
+
+const cgroupCPUPeriod = 100000 // cpu.max 的周期（微秒）
+
+// cgroupManager creates child cgroups under the cgroup v2 hierarchy the
+// agent runs in
+type cgroupManager struct {
+	base        string   // agent 所在 cgroup 的目录
+	controllers []string // 已在子树中启用的控制器
+}
+
+// resourceGroup confines a single command, either in its own cgroup or, when
+// cgroups are unavailable, with rlimits set before it executes
+type resourceGroup struct {
+	limits  resourceLimits
+	applied resourceLimits // 实际生效的限制
+	cgroup  *os.File       // cgroup 目录，为 nil 时使用 rlimit
+	path    string
+}
+
+var (
+	cgroupOnce sync.Once
+	cgroupMgr  *cgroupManager
+	cgroupErr  error
+
+	// 在 cgroup 中启动命令失败（如 clone3 不可用或被 seccomp 拒绝）后不再使用 cgroup
+	cgroupStartFailed atomic.Bool
+)
+
+// cgroups returns the shared cgroup manager, initialising it on first use.
+// moveAgent allows moving the agent into a leaf cgroup when that is needed
+// to enable the controllers.
+func cgroups(moveAgent bool) (*cgroupManager, error) {
+	cgroupOnce.Do(func() {
+		cgroupMgr, cgroupErr = newCgroupManager(moveAgent)
+	})
+	return cgroupMgr, cgroupErr
+}
+
+func newCgroupManager(moveAgent bool) (*cgroupManager, error) {
+	mount, err := cgroup2Mount()
+	if err != nil {
+		return nil, err
+	}
+	self, err := cgroup2Path()
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Join(mount, self)
+
+	data, err := os.ReadFile(filepath.Join(base, "cgroup.controllers"))
+	if err != nil {
+		return nil, err
+	}
+	available := make(map[string]bool)
+	for _, c := range strings.Fields(string(data)) {
+		available[c] = true
+	}
+
+	var enable []string
+	var controllers []string
+	for _, c := range []string{"cpu", "memory", "pids"} {
+		if available[c] {
+			enable = append(enable, "+"+c)
+			controllers = append(controllers, c)
+		}
+	}
+	if len(enable) == 0 {
+		return nil, errors.New("no cgroup v2 controllers available")
+	}
+
+	subtree := filepath.Join(base, "cgroup.subtree_control")
+	if err := os.WriteFile(subtree, []byte(strings.Join(enable, " ")), 0644); err != nil {
+		// cgroup v2 不允许在含有进程的非根 cgroup 中启用控制器，
+		// 配置允许时先把 agent 自身移入叶子 cgroup 再重试
+		if !moveAgent {
+			return nil, fmt.Errorf("failed to enable cgroup controllers: %w", err)
+		}
+		leaf := filepath.Join(base, "agent")
+		if err := os.MkdirAll(leaf, 0755); err != nil {
+			return nil, err
+		}
+		pid := []byte(strconv.Itoa(os.Getpid()))
+		if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), pid, 0644); err != nil {
+			return nil, err
+		}
+		log.Printf("Moved agent into cgroup %s to enable the %s controllers", leaf, strings.Join(controllers, ", "))
+		if err := os.WriteFile(subtree, []byte(strings.Join(enable, " ")), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cgroupManager{base: base, controllers: controllers}, nil
+}
+
+// cgroup2Mount returns the mount point of the cgroup v2 hierarchy
+func cgroup2Mount() (string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 格式: id parent major:minor root mountpoint options ... - fstype source super_options
+		line := scanner.Text()
+		pre, post, ok := strings.Cut(line, " - ")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(pre)
+		postFields := strings.Fields(post)
+		if len(fields) >= 5 && len(postFields) >= 1 && postFields[0] == "cgroup2" {
+			return fields[4], nil
+		}
+	}
+	return "", errors.New("cgroup v2 is not mounted")
+}
+
+// cgroup2Path returns the cgroup v2 path of the agent process
+func cgroup2Path() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", errors.New("agent is not in a cgroup v2 hierarchy")
+}
+
+// newResourceGroup prepares cmd to run under limits. It returns nil when no
+// limits apply. The command is placed into a new cgroup when possible and
+// falls back to rlimits otherwise. A limit the request asks for explicitly
+// that cannot be enforced either way is rejected.
+func (s *ExecService) newResourceGroup(cmd *exec.Cmd, limits resourceLimits) (*resourceGroup, error) {
+	if limits.empty() {
+		return nil, nil
+	}
+
+	mgr, err := cgroups(s.cfg.CgroupMoveAgent)
+	if err != nil || cgroupStartFailed.Load() {
+		return rlimitGroup(limits)
+	}
+	for _, c := range []struct {
+		controller string
+		requested  bool
+	}{
+		{"cpu", limits.requested.CPUs > 0},
+		{"memory", limits.requested.MemoryBytes > 0},
+		{"pids", limits.requested.Pids > 0},
+	} {
+		if c.requested && !mgr.has(c.controller) {
+			return nil, newError(CodeInvalidRequest, "the %s cgroup controller is not available, so the %s limit cannot be applied", c.controller, c.controller)
+		}
+	}
+
+	path := filepath.Join(mgr.base, "cmd-"+uuid.New().String())
+	if err := os.Mkdir(path, 0755); err != nil {
+		return rlimitGroup(limits)
+	}
+	applied, err := mgr.configure(path, limits)
+	if err != nil {
+		os.Remove(path)
+		return rlimitGroup(limits)
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		os.Remove(path)
+		return rlimitGroup(limits)
+	}
+
+	// 通过 clone3 直接在目标 cgroup 中创建子进程，避免启动后再迁移的竞态
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+
+	return &resourceGroup{limits: limits, applied: applied, cgroup: dir, path: path}, nil
+}
+
+// rlimitGroup is the fallback when no cgroup can be created. RLIMIT_NPROC
+// counts every process of the user rather than those of one command and does
+// not apply to root, so pids cannot be limited this way; a request that asks
+// for it is rejected, and a default pids limit is not enforced.
+func rlimitGroup(limits resourceLimits) (*resourceGroup, error) {
+	if limits.requested.Pids > 0 {
+		return nil, newError(CodeInvalidRequest, "the pids limit requires cgroup v2, which is not available")
+	}
+	return &resourceGroup{limits: limits}, nil
+}
+
+// configure writes the limits into the control files of a cgroup and returns
+// the limits that were set; those whose controller is not enabled are skipped
+func (m *cgroupManager) configure(path string, limits resourceLimits) (resourceLimits, error) {
+	var applied resourceLimits
+	write := func(file, value string) error {
+		if err := os.WriteFile(filepath.Join(path, file), []byte(value), 0644); err != nil {
+			return fmt.Errorf("failed to set %s: %w", file, err)
+		}
+		return nil
+	}
+
+	if limits.cpus > 0 && m.has("cpu") {
+		quota := int64(math.Ceil(limits.cpus * cgroupCPUPeriod))
+		if err := write("cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)); err != nil {
+			return applied, err
+		}
+		applied.cpus = limits.cpus
+	}
+	if limits.memoryBytes > 0 && m.has("memory") {
+		if err := write("memory.max", strconv.FormatInt(limits.memoryBytes, 10)); err != nil {
+			return applied, err
+		}
+		// 不允许使用 swap 绕过内存限制，内核不支持时忽略
+		write("memory.swap.max", "0")
+		applied.memoryBytes = limits.memoryBytes
+	}
+	if limits.pids > 0 && m.has("pids") {
+		if err := write("pids.max", strconv.FormatInt(limits.pids, 10)); err != nil {
+			return applied, err
+		}
+		applied.pids = limits.pids
+	}
+	return applied, nil
+}
+
+func (m *cgroupManager) has(controller string) bool {
+	for _, c := range m.controllers {
+		if c == controller {
+			return true
+		}
+	}
+	return false
+}
+
+// mode reports how the limits are enforced, or "" when none took effect
+func (g *resourceGroup) mode() string {
+	switch {
+	case g == nil || g.applied.empty():
+		return ""
+	case g.cgroup != nil:
+		return LimitModeCgroup
+	default:
+		return LimitModeRlimit
+	}
+}
+
+// appliedLimits returns the limits that took effect, or nil when none did
+func (g *resourceGroup) appliedLimits() *model.ResourceLimits {
+	if g == nil {
+		return nil
+	}
+	return g.applied.model()
+}
+
+// start prepares and starts cmd. The command joins its cgroup through
+// clone3, which may be unavailable or rejected by seccomp; it is then started
+// again from a copy of cmd with rlimits, unless it asks for a pids limit, and
+// later commands no longer use cgroups. The command that was started is
+// returned.
+func (g *resourceGroup) start(cmd *exec.Cmd, timeout time.Duration) (*exec.Cmd, error) {
+	if err := g.prepare(cmd, timeout); err != nil {
+		return nil, err
+	}
+	err := cmd.Start()
+	if err == nil || g == nil || g.cgroup == nil || cmd.Err != nil || g.limits.requested.Pids > 0 {
+		return cmd, err
+	}
+
+	retry := &exec.Cmd{
+		Path:       cmd.Path,
+		Args:       cmd.Args,
+		Env:        cmd.Env,
+		Dir:        cmd.Dir,
+		Stdin:      cmd.Stdin,
+		Stdout:     cmd.Stdout,
+		Stderr:     cmd.Stderr,
+		ExtraFiles: cmd.ExtraFiles,
+		WaitDelay:  cmd.WaitDelay,
+	}
+	attr := *cmd.SysProcAttr
+	attr.UseCgroupFD = false
+	attr.CgroupFD = 0
+	retry.SysProcAttr = &attr
+
+	g.cgroup.Close()
+	g.remove()
+	g.cgroup = nil
+	g.path = ""
+	g.applied = resourceLimits{}
+	if err := g.prepare(retry, timeout); err != nil {
+		return nil, err
+	}
+	// 重试仍然失败时，错误与 cgroup 无关，返回重试的错误
+	if err := retry.Start(); err != nil {
+		return nil, err
+	}
+	if errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EPERM) {
+		if !cgroupStartFailed.Swap(true) {
+			log.Printf("Starting commands in a cgroup failed (%v), falling back to rlimits", err)
+		}
+	}
+	return retry, nil
+}
+
+// prepare arranges for rlimits to be set on cmd before it executes when no
+// cgroup is used: cmd is rewritten to run through the rlimit shim, which sets
+// them and then execs the original command. CPU quota cannot be expressed as
+// an rlimit, so it is converted into a CPU time budget over the command
+// timeout, and not applied without one. The shim runs as the user of the
+// command, so the limits cannot be set when that user may not execute the
+// agent; this is an error for limits the request asks for explicitly, and
+// default limits are then not enforced.
+func (g *resourceGroup) prepare(cmd *exec.Cmd, timeout time.Duration) error {
+	if g == nil || g.cgroup != nil {
+		return nil
+	}
+
+	var memory, cpu uint64
+	if g.limits.memoryBytes > 0 {
+		memory = uint64(g.limits.memoryBytes)
+	}
+	if g.limits.cpus > 0 && timeout > 0 {
+		cpu = uint64(math.Ceil(g.limits.cpus * timeout.Seconds()))
+	}
+	if memory == 0 && cpu == 0 {
+		return nil
+	}
+
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Credential != nil {
+		cred := cmd.SysProcAttr.Credential
+		exe, err := os.Executable()
+		if err != nil || !executableBy(exe, cred) {
+			if g.limits.requested.MemoryBytes > 0 || g.limits.requested.CPUs > 0 {
+				return newError(CodeInvalidRequest, "rlimits are set by running the agent executable as the command user, which uid %d cannot execute", cred.Uid)
+			}
+			return nil
+		}
+	}
+
+	if memory > 0 {
+		g.applied.memoryBytes = g.limits.memoryBytes
+	}
+	if cpu > 0 {
+		g.applied.cpus = g.limits.cpus
+	}
+	args := []string{rlimitShim, strconv.FormatUint(memory, 10), strconv.FormatUint(cpu, 10), cmd.Path}
+	cmd.Args = append(args, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+	return nil
+}
+
+// executableBy reports whether the user of cred may execute the file at the
+// absolute path, judged by the mode bits of the file and the directories
+// above it
+func executableBy(path string, cred *syscall.Credential) bool {
+	allowed := func(info os.FileInfo, dir bool) bool {
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return false
+		}
+		perm := uint32(info.Mode().Perm())
+		if cred.Uid == 0 {
+			// root 可以搜索任何目录，执行任何带有执行位的文件
+			return dir || perm&0111 != 0
+		}
+		switch {
+		case st.Uid == cred.Uid:
+			return perm&0100 != 0
+		case st.Gid == cred.Gid || containsGroup(cred.Groups, st.Gid):
+			return perm&0010 != 0
+		default:
+			return perm&0001 != 0
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || !allowed(info, false) {
+		return false
+	}
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err != nil || !allowed(info, true) {
+			return false
+		}
+		if dir == "/" {
+			return true
+		}
+	}
+}
+
+func containsGroup(groups []uint32, gid uint32) bool {
+	for _, g := range groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// rlimitShim is the argv[0] under which the agent re-executes itself to set
+// rlimits in the child before the command runs. Its arguments are the
+// RLIMIT_AS and RLIMIT_CPU values, 0 meaning unset, the path of the command
+// and its argv.
+const rlimitShim = "litterbox-rlimit"
+
+func init() {
+	if len(os.Args) > 0 && os.Args[0] == rlimitShim {
+		runRlimitShim(os.Args[1:])
+	}
+}
+
+// runRlimitShim sets the rlimits and replaces the process with the command.
+// Everything execve needs is allocated first, so that nothing is allocated
+// once RLIMIT_AS is in place.
+func runRlimitShim(args []string) {
+	fail := func(format string, a ...interface{}) {
+		fmt.Fprintf(os.Stderr, "litterbox-agent: "+format+"\n", a...)
+		os.Exit(126)
+	}
+	if len(args) < 4 {
+		fail("invalid rlimit shim arguments")
+	}
+	memory, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		fail("invalid memory limit: %v", err)
+	}
+	cpu, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		fail("invalid cpu limit: %v", err)
+	}
+
+	path, err := syscall.BytePtrFromString(args[2])
+	if err != nil {
+		fail("invalid path: %v", err)
+	}
+	argv, err := syscall.SlicePtrFromStrings(args[3:])
+	if err != nil {
+		fail("invalid argument: %v", err)
+	}
+	envv, err := syscall.SlicePtrFromStrings(os.Environ())
+	if err != nil {
+		fail("invalid environment: %v", err)
+	}
+
+	if cpu > 0 {
+		if err := prlimit(0, syscall.RLIMIT_CPU, cpu); err != nil {
+			fail("failed to set RLIMIT_CPU: %v", err)
+		}
+	}
+	if memory > 0 {
+		if err := prlimit(0, syscall.RLIMIT_AS, memory); err != nil {
+			fail("failed to set RLIMIT_AS: %v", err)
+		}
+	}
+
+	_, _, errno := syscall.RawSyscall(syscall.SYS_EXECVE,
+		uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&argv[0])), uintptr(unsafe.Pointer(&envv[0])))
+	fail("exec %s: %v", args[2], errno)
+}
+
+// finish collects the resource usage of a finished command and removes its
+// cgroup, killing any processes left behind in it
+func (g *resourceGroup) finish(state *os.ProcessState) resourceUsage {
+	usage := rusageOf(state)
+	if g == nil || g.path == "" {
+		return usage
+	}
+
+	if peak, err := readCgroupInt(g.path, "memory.peak"); err == nil {
+		usage.peakMemoryBytes = peak
+	}
+	if usec, err := readCgroupStat(g.path, "cpu.stat", "usage_usec"); err == nil {
+		usage.cpuTime = time.Duration(usec) * time.Microsecond
+	}
+
+	g.cgroup.Close()
+	g.remove()
+	return usage
+}
+
+// remove kills the remaining processes of the cgroup and deletes it
+func (g *resourceGroup) remove() {
+	if err := os.WriteFile(filepath.Join(g.path, "cgroup.kill"), []byte("1"), 0644); err != nil {
+		// cgroup.kill 需要 5.14 以上内核，否则逐个终止
+		if data, err := os.ReadFile(filepath.Join(g.path, "cgroup.procs")); err == nil {
+			for _, field := range strings.Fields(string(data)) {
+				if pid, err := strconv.Atoi(field); err == nil {
+					syscall.Kill(pid, syscall.SIGKILL)
+				}
+			}
+		}
+	}
+
+	// 进程退出需要一点时间，cgroup 在此之前无法删除
+	for i := 0; i < 50; i++ {
+		if err := os.Remove(g.path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func readCgroupInt(path, file string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(path, file))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func readCgroupStat(path, file, key string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(path, file))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, key+" "); ok {
+			return strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("%s not found in %s", key, file)
+}
+
+// prlimit sets both the soft and hard limit of a resource for a process, or
+// for the calling process when pid is 0
+func prlimit(pid, resource int, value uint64) error {
+	limit := syscall.Rlimit{Cur: value, Max: value}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64,
+		uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// maxRSSBytes returns the peak resident set size of a process; Linux reports
+// it in kilobytes
+func maxRSSBytes(state *os.ProcessState) int64 {
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		return int64(rusage.Maxrss) * 1024
+	}
+	return 0
+}
@@ -0,0 +1,105 @@
+//go:build linux
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRlimitsSetBeforeExec(t *testing.T) {
+	s := newTestExecService()
+
+	rg := &resourceGroup{limits: resourceLimits{cpus: 0.5, memoryBytes: 512 << 20}}
+	cmd := s.command("sh", "-c", "ulimit -v; ulimit -t")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	result := s.run(context.Background(), cmd, rg, 10*time.Second)
+	if result.err != nil || result.exitCode != 0 {
+		t.Fatalf("exit code %d, err %v, stderr %q", result.exitCode, result.err, stderr.String())
+	}
+	// ulimit -v 以 KB 为单位，CPU 时间预算为 0.5 核 × 10 秒
+	if got, want := stdout.String(), "524288\n5\n"; got != want {
+		t.Errorf("limits seen by the command %q, want %q", got, want)
+	}
+	if result.limitMode != LimitModeRlimit {
+		t.Errorf("limit mode %q, want %q", result.limitMode, LimitModeRlimit)
+	}
+	if applied := result.appliedLimits; applied == nil || applied.MemoryBytes != 512<<20 || applied.CPUs != 0.5 {
+		t.Errorf("applied limits %+v", applied)
+	}
+}
+
+func TestStartFallsBackToRlimits(t *testing.T) {
+	s := newTestExecService()
+
+	// 不是 cgroup 目录的描述符会让 clone3 失败，和内核不支持时一样
+	dir := t.TempDir()
+	notCgroup, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rg := &resourceGroup{
+		limits: resourceLimits{memoryBytes: 512 << 20},
+		cgroup: notCgroup,
+		path:   filepath.Join(dir, "missing"),
+	}
+	cmd := s.command("sh", "-c", "ulimit -v")
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(notCgroup.Fd())
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	result := s.run(context.Background(), cmd, rg, 10*time.Second)
+	if result.err != nil || result.exitCode != 0 {
+		t.Fatalf("exit code %d, err %v, stderr %q", result.exitCode, result.err, stderr.String())
+	}
+	if got := stdout.String(); got != "524288\n" {
+		t.Errorf("memory limit seen by the command %q, want 524288", got)
+	}
+	if result.limitMode != LimitModeRlimit {
+		t.Errorf("limit mode %q, want %q", result.limitMode, LimitModeRlimit)
+	}
+}
+
+func TestExecutableBy(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{filepath.Dir(dir), dir} {
+		if err := os.Chmod(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "agent")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root := &syscall.Credential{Uid: 0, Gid: 0}
+	nobody := &syscall.Credential{Uid: 65534, Gid: 65534}
+	for _, tt := range []struct {
+		mode      os.FileMode
+		dirMode   os.FileMode
+		cred      *syscall.Credential
+		wantAllow bool
+	}{
+		{0755, 0755, nobody, true},
+		{0750, 0755, nobody, false},
+		{0755, 0700, nobody, false},
+		{0700, 0700, root, true},
+		{0644, 0755, root, false},
+	} {
+		os.Chmod(path, tt.mode)
+		os.Chmod(dir, tt.dirMode)
+		if got := executableBy(path, tt.cred); got != tt.wantAllow {
+			t.Errorf("executableBy(file %o, dir %o, uid %d) = %v, want %v", tt.mode, tt.dirMode, tt.cred.Uid, got, tt.wantAllow)
+		}
+	}
+}
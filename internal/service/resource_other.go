@@ -0,0 +1,48 @@
+//go:build !linux
+
+package service
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"litterbox-agent/internal/model"
+)
+
+// resourceGroup is a placeholder on platforms without cgroup support
+type resourceGroup struct{}
+
+// newResourceGroup rejects resource limits, which are only supported on Linux
+func (s *ExecService) newResourceGroup(cmd *exec.Cmd, limits resourceLimits) (*resourceGroup, error) {
+	if limits.empty() {
+		return nil, nil
+	}
+	return nil, newError(CodeInvalidRequest, "resource limits are only supported on Linux")
+}
+
+func (g *resourceGroup) mode() string {
+	return ""
+}
+
+func (g *resourceGroup) appliedLimits() *model.ResourceLimits {
+	return nil
+}
+
+func (g *resourceGroup) start(cmd *exec.Cmd, timeout time.Duration) (*exec.Cmd, error) {
+	return cmd, cmd.Start()
+}
+
+func (g *resourceGroup) finish(state *os.ProcessState) resourceUsage {
+	return rusageOf(state)
+}
+
+// maxRSSBytes returns the peak resident set size of a process; BSD-derived
+// systems report it in bytes
+func maxRSSBytes(state *os.ProcessState) int64 {
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		return int64(rusage.Maxrss)
+	}
+	return 0
+}
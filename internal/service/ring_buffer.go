@@ -0,0 +1,72 @@
+package service
+
+import "sync"
+
+// ringBuffer is a bounded, concurrency-safe writer that keeps only the most
+// recent bytes written to it
+type ringBuffer struct {
+	mu    sync.Mutex
+	buf   []byte
+	size  int
+	start int   // 最旧数据所在位置
+	total int64 // 累计写入的字节数
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	if size <= 0 {
+		size = 1
+	}
+	return &ringBuffer{
+		buf:  make([]byte, 0, size),
+		size: size,
+	}
+}
+
+func (b *ringBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(p)
+	b.total += int64(n)
+
+	// 只需保留最后 size 个字节
+	if len(p) > b.size {
+		p = p[len(p)-b.size:]
+	}
+
+	for len(p) > 0 {
+		if len(b.buf) < b.size {
+			free := b.size - len(b.buf)
+			if free > len(p) {
+				free = len(p)
+			}
+			b.buf = append(b.buf, p[:free]...)
+			p = p[free:]
+			continue
+		}
+
+		copied := copy(b.buf[b.start:], p)
+		p = p[copied:]
+		b.start = (b.start + copied) % b.size
+	}
+
+	return n, nil
+}
+
+// Bytes returns a copy of the retained data in write order
+func (b *ringBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make([]byte, 0, len(b.buf))
+	out = append(out, b.buf[b.start:]...)
+	out = append(out, b.buf[:b.start]...)
+	return out
+}
+
+// Dropped returns how many bytes have been discarded because the buffer was full
+func (b *ringBuffer) Dropped() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total - int64(len(b.buf))
+}
@@ -0,0 +1,552 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+
+	"litterbox-agent/internal/config"
+	"litterbox-agent/internal/model"
+)
+
+type SessionService struct {
+	execService *ExecService
+	cfg         config.SessionConfig
+
+	mu       sync.RWMutex
+	sessions map[string]*shellSession
+}
+
+// shellSession is a long-lived shell that runs commands one at a time, so
+// that the working directory, variables and functions persist between calls
+type shellSession struct {
+	id        string
+	name      string
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	marker    string
+	createdAt time.Time
+	killGrace time.Duration
+	abortFile string // 该文件存在时 bash 中止当前命令；为空表示 shell 是 sh，无法中止
+
+	newOutputBuffer func() *outputBuffer
+
+	stdoutFrames chan sessionFrame
+	stderrFrames chan sessionFrame
+
+	execMu sync.Mutex // 同一会话中的命令串行执行
+
+	mu       sync.Mutex
+	lastUsed time.Time
+	exited   bool
+	exitCode int
+	done     chan struct{}
+}
+
+// sessionFrame is the output of one command on one stream, delimited by the
+// session marker. eof is set when the shell closed the stream instead.
+type sessionFrame struct {
+	output    string
+	truncated bool
+	total     int64
+	exitCode  int
+	eof       bool
+}
+
+func NewSessionService(execService *ExecService, cfg config.SessionConfig) *SessionService {
+	s := &SessionService{
+		execService: execService,
+		cfg:         cfg,
+		sessions:    make(map[string]*shellSession),
+	}
+	go s.reapLoop()
+	return s
+}
+
+// sessionSetup prepares a bash session so that a command can be aborted as
+// a whole. Commands run inside __litterbox_run; once the abort file named by
+// %s exists, the DEBUG trap makes every further command inside a function
+// return, which unwinds nested functions and loops alike while the shell and
+// its state survive. extdebug is what lets the trap return. A file is used
+// rather than a signal because bash may run a pending trap only after the
+// next command has started.
+const sessionSetup = `shopt -s extdebug
+__litterbox_abort_file=%s
+trap '[[ ${#FUNCNAME[@]} -eq 0 || ! -e $__litterbox_abort_file ]] || return 2' DEBUG
+__litterbox_run() { command eval "$1"; }
+`
+
+// CreateSession starts a new shell session. The shell is bash when it is
+// installed, since only bash lets a timed-out command be aborted without
+// ending the session, and sh otherwise.
+func (s *SessionService) CreateSession(req *model.SessionRequest) (*model.SessionInfo, error) {
+	id := "sess-" + uuid.New().String()
+	cmd, abortFile := s.execService.command("sh"), ""
+	if bash, err := exec.LookPath("bash"); err == nil {
+		cmd = s.execService.command(bash, "--norc", "--noprofile")
+		abortFile = filepath.Join(os.TempDir(), "litterbox-"+id+".abort")
+	}
+	if err := s.execService.applyUserEnvironment(cmd, req.User, req.Group, req.Cwd, req.Env, req.ReplaceEnv); err != nil {
+		return nil, err
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	if abortFile != "" {
+		if _, err := io.WriteString(stdin, fmt.Sprintf(sessionSetup, shellQuote(abortFile))); err != nil {
+			signalGroup(cmd, syscall.SIGKILL)
+			cmd.Wait()
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	ss := &shellSession{
+		id:        id,
+		name:      req.Name,
+		cmd:       cmd,
+		stdin:     stdin,
+		marker:    "__LITTERBOX_" + strings.ReplaceAll(uuid.New().String(), "-", "") + "__",
+		createdAt: now,
+		killGrace: s.execService.cfg.KillGrace,
+		abortFile: abortFile,
+
+		newOutputBuffer: s.execService.newOutputBuffer,
+		stdoutFrames:    make(chan sessionFrame, 1),
+		stderrFrames:    make(chan sessionFrame, 1),
+		lastUsed:        now,
+		done:            make(chan struct{}),
+	}
+
+	go ss.readFrames(stdout, ss.stdoutFrames)
+	go ss.readFrames(stderr, ss.stderrFrames)
+	go func() {
+		exitCode := 0
+		if err := cmd.Wait(); err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				exitCode = exitErr.ExitCode()
+			} else {
+				exitCode = 127
+			}
+		}
+
+		ss.mu.Lock()
+		ss.exited = true
+		ss.exitCode = exitCode
+		ss.mu.Unlock()
+		close(ss.done)
+	}()
+
+	s.mu.Lock()
+	s.sessions[ss.id] = ss
+	s.mu.Unlock()
+
+	return ss.info(), nil
+}
+
+// Exec runs a command inside a session and returns its own output and exit code
+func (s *SessionService) Exec(ctx context.Context, id string, req *model.CommandRequest) (*model.CommandResponse, error) {
+	ss, err := s.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	return ss.exec(ctx, req.Command, s.execService.timeout(req.TimeoutMs))
+}
+
+// GetSession returns information about a session
+func (s *SessionService) GetSession(id string) (*model.SessionInfo, error) {
+	ss, err := s.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	return ss.info(), nil
+}
+
+// ListSessions returns all sessions ordered by creation time
+func (s *SessionService) ListSessions() []*model.SessionInfo {
+	s.mu.RLock()
+	sessions := make([]*shellSession, 0, len(s.sessions))
+	for _, ss := range s.sessions {
+		sessions = append(sessions, ss)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(sessions, func(a, b int) bool {
+		return sessions[a].createdAt.Before(sessions[b].createdAt)
+	})
+
+	infos := make([]*model.SessionInfo, 0, len(sessions))
+	for _, ss := range sessions {
+		infos = append(infos, ss.info())
+	}
+	return infos
+}
+
+// CloseSession terminates the shell of a session and forgets it
+func (s *SessionService) CloseSession(id string) error {
+	s.mu.Lock()
+	ss, ok := s.sessions[id]
+	delete(s.sessions, id)
+	s.mu.Unlock()
+
+	if !ok {
+		return newError(CodeNotFound, "session not found: %s", id)
+	}
+
+	ss.close()
+	return nil
+}
+
+func (s *SessionService) lookup(id string) (*shellSession, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ss, ok := s.sessions[id]
+	if !ok {
+		return nil, newError(CodeNotFound, "session not found: %s", id)
+	}
+	return ss, nil
+}
+
+// reapLoop periodically closes sessions that have been idle for too long
+func (s *SessionService) reapLoop() {
+	interval := s.cfg.IdleTimeout / 2
+	if interval <= 0 || interval > time.Minute {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.reap(time.Now())
+	}
+}
+
+func (s *SessionService) reap(now time.Time) {
+	var idle []*shellSession
+
+	s.mu.Lock()
+	for id, ss := range s.sessions {
+		ss.mu.Lock()
+		expired := now.Sub(ss.lastUsed) > s.cfg.IdleTimeout
+		ss.mu.Unlock()
+
+		if expired {
+			delete(s.sessions, id)
+			idle = append(idle, ss)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, ss := range idle {
+		go ss.close()
+	}
+}
+
+// exec writes a framed command to the shell and collects its output. The
+// command is evaluated with `command eval` so that syntax errors do not
+// terminate the shell, and with stdin redirected so that it cannot consume
+// the following frames. A command that times out or is cancelled reports
+// exit code -1.
+func (ss *shellSession) exec(ctx context.Context, command string, timeout time.Duration) (*model.CommandResponse, error) {
+	ss.execMu.Lock()
+	defer ss.execMu.Unlock()
+
+	if ss.hasExited() {
+		return nil, errSessionClosed()
+	}
+	ss.touch()
+	defer ss.touch()
+
+	run := "command eval"
+	if ss.abortFile != "" {
+		os.Remove(ss.abortFile)
+		run = "__litterbox_run"
+	}
+	script := fmt.Sprintf("%s %s </dev/null\n"+
+		"__litterbox_rc=$?\n"+
+		"printf '\\n%%s %%d\\n' '%s' \"$__litterbox_rc\"\n"+
+		"printf '\\n%%s\\n' '%s' >&2\n",
+		run, shellQuote(command), ss.marker, ss.marker)
+
+	start := time.Now()
+	if _, err := io.WriteString(ss.stdin, script); err != nil {
+		return nil, errSessionClosed()
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	var stdout, stderr *sessionFrame
+	timedOut, interrupted := false, false
+	cancelled := ctx.Done()
+	var grace <-chan time.Time
+	stopEscalation := func() {}
+	interrupt := func() {
+		interrupted = true
+		deadline, cancelled = nil, nil
+		if stop := ss.interrupt(); stop != nil {
+			stopEscalation = stop
+			grace = time.After(ss.killGrace)
+		}
+	}
+
+	for stdout == nil || stderr == nil {
+		select {
+		case frame := <-ss.stdoutFrames:
+			stdout = &frame
+		case frame := <-ss.stderrFrames:
+			stderr = &frame
+		case <-deadline:
+			timedOut = true
+			interrupt()
+		case <-cancelled:
+			interrupt()
+		case <-grace:
+			// 命令仍未结束，只能终止整个会话
+			grace = nil
+			ss.kill()
+		}
+	}
+	// 之后的 SIGKILL 会落到下一条命令的子进程上
+	stopEscalation()
+
+	response := &model.CommandResponse{
+		Stdout:          strings.TrimRight(stdout.output, "\n"),
+		Stderr:          strings.TrimRight(stderr.output, "\n"),
+		ExitCode:        stdout.exitCode,
+		TimedOut:        timedOut,
+		DurationMs:      time.Since(start).Milliseconds(),
+		StdoutTruncated: stdout.truncated,
+		StderrTruncated: stderr.truncated,
+		StdoutBytes:     stdout.total,
+		StderrBytes:     stderr.total,
+	}
+
+	if stdout.eof || stderr.eof {
+		// shell 已退出（例如执行了 exit），返回 shell 的退出码
+		<-ss.done
+		ss.mu.Lock()
+		response.ExitCode = ss.exitCode
+		ss.mu.Unlock()
+	}
+	if interrupted {
+		response.ExitCode = -1
+	}
+
+	return response, nil
+}
+
+// interrupt aborts the current command without killing the shell itself:
+// the abort file tells bash to skip the rest of the command, and the
+// processes the command started get SIGTERM and, halfway through the grace
+// period, SIGKILL. It returns a function that cancels the SIGKILL once the
+// command has finished. sh cannot skip the rest of a command, so there the
+// whole session is killed right away and nil is returned.
+func (ss *shellSession) interrupt() (stop func()) {
+	// 须先于终止子进程创建，子进程结束后 bash 执行的下一条命令即被跳过
+	if ss.abortFile == "" || os.WriteFile(ss.abortFile, nil, 0644) != nil {
+		ss.kill()
+		return nil
+	}
+	signalProcesses(descendants(ss.cmd.Process.Pid), syscall.SIGTERM)
+
+	var mu sync.Mutex
+	stopped := false
+	timer := time.AfterFunc(ss.killGrace/2, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !stopped {
+			signalProcesses(descendants(ss.cmd.Process.Pid), syscall.SIGKILL)
+		}
+	})
+	return func() {
+		timer.Stop()
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+	}
+}
+
+// kill terminates the shell and everything it started
+func (ss *shellSession) kill() {
+	signalGroup(ss.cmd, syscall.SIGKILL)
+}
+
+// close asks the shell to exit, escalating to SIGTERM and SIGKILL
+func (ss *shellSession) close() {
+	ss.stdin.Close()
+	signalGroup(ss.cmd, syscall.SIGTERM)
+
+	select {
+	case <-ss.done:
+	case <-time.After(ss.killGrace):
+		ss.kill()
+		<-ss.done
+	}
+	if ss.abortFile != "" {
+		os.Remove(ss.abortFile)
+	}
+}
+
+// readFrames splits a shell output stream into per-command frames
+func (ss *shellSession) readFrames(r io.Reader, frames chan<- sessionFrame) {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	buf := ss.newOutputBuffer()
+	lineStart := true
+
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if lineStart && bytes.HasPrefix(chunk, []byte(ss.marker)) && err == nil {
+			exitCode, _ := strconv.Atoi(strings.TrimSpace(string(chunk[len(ss.marker):])))
+			frames <- newSessionFrame(buf, exitCode, false)
+			buf.Reset()
+			continue
+		}
+
+		buf.Write(chunk)
+		lineStart = err == nil
+
+		if err != nil && err != bufio.ErrBufferFull {
+			frames <- newSessionFrame(buf, 0, true)
+			return
+		}
+	}
+}
+
+func newSessionFrame(buf *outputBuffer, exitCode int, eof bool) sessionFrame {
+	// 分隔标记前额外输出的换行符不计入输出
+	total := buf.Total()
+	if !eof && total > 0 {
+		total--
+	}
+	return sessionFrame{
+		output:    buf.String(),
+		truncated: buf.Truncated(),
+		total:     total,
+		exitCode:  exitCode,
+		eof:       eof,
+	}
+}
+
+func (ss *shellSession) touch() {
+	ss.mu.Lock()
+	ss.lastUsed = time.Now()
+	ss.mu.Unlock()
+}
+
+// errSessionClosed reports a command sent to a session whose shell has exited
+func errSessionClosed() error {
+	return newError(CodeConflict, "session has exited")
+}
+
+func (ss *shellSession) hasExited() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.exited
+}
+
+func (ss *shellSession) info() *model.SessionInfo {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	info := &model.SessionInfo{
+		ID:         ss.id,
+		Name:       ss.name,
+		Pid:        ss.cmd.Process.Pid,
+		Alive:      !ss.exited,
+		CreatedAt:  ss.createdAt,
+		LastUsedAt: ss.lastUsed,
+	}
+	if ss.exited {
+		exitCode := ss.exitCode
+		info.ExitCode = &exitCode
+	}
+	return info
+}
+
+// shellQuote quotes s as a single shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// descendants returns the pids of all descendants of pid, found via /proc
+func descendants(pid int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// 格式: pid (comm) state ppid ...，comm 中可能包含空格和括号
+		stat := string(data)
+		fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], child)
+	}
+
+	var result []int
+	queue := []int{pid}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, child := range children[current] {
+			result = append(result, child)
+			queue = append(queue, child)
+		}
+	}
+	return result
+}
+
+func signalProcesses(pids []int, sig syscall.Signal) {
+	for _, pid := range pids {
+		syscall.Kill(pid, sig)
+	}
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"litterbox-agent/internal/config"
+	"litterbox-agent/internal/model"
+)
+
+func newTestSessionService(t *testing.T) (*SessionService, string) {
+	t.Helper()
+
+	s := NewSessionService(newTestExecService(), config.SessionConfig{IdleTimeout: time.Hour})
+	info, err := s.CreateSession(&model.SessionRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.CloseSession(info.ID) })
+	return s, info.ID
+}
+
+// mustExec runs a command in a session and fails the test unless it exits 0
+func mustExec(t *testing.T, s *SessionService, id, command string) *model.CommandResponse {
+	t.Helper()
+	resp, err := s.Exec(context.Background(), id, &model.CommandRequest{Command: command})
+	if err != nil {
+		t.Fatalf("%s: %v", command, err)
+	}
+	if resp.ExitCode != 0 {
+		t.Fatalf("%s: exit code %d, stderr %q", command, resp.ExitCode, resp.Stderr)
+	}
+	return resp
+}
+
+func TestSessionStatePersists(t *testing.T) {
+	s, id := newTestSessionService(t)
+	dir := t.TempDir()
+
+	mustExec(t, s, id, "cd "+shellQuote(dir))
+	mustExec(t, s, id, "export GREETING=hello; count=3")
+	mustExec(t, s, id, "greet() { echo \"$GREETING $1 $count\"; }")
+
+	if resp := mustExec(t, s, id, "pwd"); resp.Stdout != dir {
+		t.Errorf("pwd = %q, want %q", resp.Stdout, dir)
+	}
+	if resp := mustExec(t, s, id, "greet world"); resp.Stdout != "hello world 3" {
+		t.Errorf("greet = %q, want %q", resp.Stdout, "hello world 3")
+	}
+	if resp := mustExec(t, s, id, "sh -c 'echo $GREETING'"); resp.Stdout != "hello" {
+		t.Errorf("exported variable in a child = %q, want %q", resp.Stdout, "hello")
+	}
+
+	resp, err := s.Exec(context.Background(), id, &model.CommandRequest{Command: "echo out; echo err >&2; false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ExitCode != 1 || resp.Stdout != "out" || resp.Stderr != "err" {
+		t.Errorf("exit code %d, stdout %q, stderr %q; want 1, \"out\", \"err\"", resp.ExitCode, resp.Stdout, resp.Stderr)
+	}
+}
+
+func TestSessionTimeoutAbortsCommand(t *testing.T) {
+	s, id := newTestSessionService(t)
+	dir := t.TempDir()
+	mustExec(t, s, id, "cd "+shellQuote(dir)+"; marker() { echo kept; }")
+
+	for _, command := range []string{
+		"sleep 5; echo late",
+		"f() { sleep 5; echo late; }; f; echo late",
+		"while :; do :; done; echo late",
+		"for i in 1 2 3; do sleep 5; echo late; done",
+	} {
+		start := time.Now()
+		resp, err := s.Exec(context.Background(), id, &model.CommandRequest{Command: command, TimeoutMs: 300})
+		if err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+		if !resp.TimedOut || resp.ExitCode != -1 {
+			t.Errorf("%s: exit code %d, timed out %v; want -1, true", command, resp.ExitCode, resp.TimedOut)
+		}
+		if strings.Contains(resp.Stdout, "late") {
+			t.Errorf("%s: stdout %q, want the rest of the command skipped", command, resp.Stdout)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("%s: returned after %v", command, elapsed)
+		}
+
+		// 会话在超时后仍然可用，之前的状态保留
+		info, err := s.GetSession(id)
+		if err != nil || !info.Alive {
+			t.Fatalf("%s: session not alive after the timeout: %+v, %v", command, info, err)
+		}
+		if resp := mustExec(t, s, id, "pwd; marker"); resp.Stdout != dir+"\nkept" {
+			t.Errorf("%s: state after the timeout = %q, want %q", command, resp.Stdout, dir+"\nkept")
+		}
+	}
+}
+
+func TestSessionExitEndsSession(t *testing.T) {
+	s, id := newTestSessionService(t)
+
+	resp, err := s.Exec(context.Background(), id, &model.CommandRequest{Command: "exit 7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ExitCode != 7 {
+		t.Errorf("exit code %d, want 7", resp.ExitCode)
+	}
+
+	_, err = s.Exec(context.Background(), id, &model.CommandRequest{Command: "true"})
+	var serviceErr *Error
+	if !errors.As(err, &serviceErr) || serviceErr.Code != CodeConflict {
+		t.Errorf("exec after exit: error = %v, want %s", err, CodeConflict)
+	}
+}
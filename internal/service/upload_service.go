@@ -0,0 +1,566 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+
+	"litterbox-agent/internal/config"
+	"litterbox-agent/internal/model"
+)
+
+const (
+	UploadStatusUploading = "uploading"
+	UploadStatusCompleted = "completed"
+)
+
+// UploadService manages resumable uploads. The data of an upload is written
+// to a staging file at arbitrary offsets, in any order and over any number of
+// requests. Once every byte has been received the file is verified and
+// renamed into place.
+type UploadService struct {
+	fileService *FileService
+	cfg         config.UploadConfig
+
+	mu      sync.RWMutex
+	uploads map[string]*upload
+}
+
+// upload is a single resumable upload session
+type upload struct {
+	id        string
+	filename  string
+	dir       string
+	size      int64
+	sha256    string
+	staging   string
+	createdAt time.Time
+
+	mu          sync.Mutex
+	file        *os.File
+	ranges      []model.ByteRange // 按起点排序且互不相邻
+	writers     int               // 正在写入的请求数
+	completing  bool              // 数据已收齐，正在校验并移动到目标位置，不再接受写入
+	status      string
+	path        string
+	lastActive  time.Time
+	completedAt time.Time
+}
+
+func NewUploadService(fileService *FileService, cfg config.UploadConfig) (*UploadService, error) {
+	if err := os.MkdirAll(cfg.StagingDir, 0700); err != nil {
+		return nil, err
+	}
+
+	// 上传会话只保存在内存中，之前运行时留下的暂存文件已无法续传
+	stale, _ := filepath.Glob(filepath.Join(cfg.StagingDir, "upload-*"))
+	for _, path := range stale {
+		os.Remove(path)
+	}
+
+	s := &UploadService{
+		fileService: fileService,
+		cfg:         cfg,
+		uploads:     make(map[string]*upload),
+	}
+	go s.reapLoop()
+	return s, nil
+}
+
+// MaxSize returns the largest accepted upload, or 0 when there is no limit
+func (s *UploadService) MaxSize() int64 {
+	return s.cfg.MaxSize
+}
+
+// CreateUpload starts a new upload session. The destination is checked
+// against the path policy now and again when the upload completes.
+func (s *UploadService) CreateUpload(req *model.UploadRequest) (*model.UploadInfo, error) {
+	if req.Filename == "" {
+		return nil, newError(CodeInvalidRequest, "filename required")
+	}
+	if !filepath.IsLocal(filepath.FromSlash(req.Filename)) {
+		return nil, newError(CodeInvalidRequest, "invalid file name: %q", req.Filename)
+	}
+	if req.Size < 0 {
+		return nil, newError(CodeInvalidRequest, "invalid size: %d", req.Size)
+	}
+	if s.cfg.MaxSize > 0 && req.Size > s.cfg.MaxSize {
+		return nil, newError(CodeTooLarge, "upload of %d bytes exceeds the limit of %d bytes", req.Size, s.cfg.MaxSize)
+	}
+	checksum := strings.ToLower(req.SHA256)
+	if checksum != "" {
+		if b, err := hex.DecodeString(checksum); err != nil || len(b) != sha256.Size {
+			return nil, newError(CodeInvalidRequest, "invalid sha256: %s", req.SHA256)
+		}
+	}
+
+	dir := s.fileService.uploadDir(req.Path)
+	dst, err := s.fileService.policy.resolve(filepath.Join(dir, filepath.FromSlash(req.Filename)))
+	if err != nil {
+		return nil, err
+	}
+
+	id := uuid.New().String()
+	file, err := os.OpenFile(filepath.Join(s.cfg.StagingDir, "upload-"+id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(req.Size); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	now := time.Now()
+	u := &upload{
+		id:         id,
+		filename:   req.Filename,
+		dir:        dir,
+		size:       req.Size,
+		sha256:     checksum,
+		staging:    file.Name(),
+		createdAt:  now,
+		file:       file,
+		status:     UploadStatusUploading,
+		path:       dst,
+		lastActive: now,
+	}
+
+	s.mu.Lock()
+	s.uploads[id] = u
+	s.mu.Unlock()
+
+	// 空文件无需上传数据
+	if req.Size == 0 {
+		u.completing = true
+		if err := s.complete(u); err != nil {
+			return nil, err
+		}
+	}
+	return s.info(u), nil
+}
+
+// StageFile copies src to a new file in the staging directory and returns
+// the file and its size. Multipart uploads spool their file parts there until
+// every form field has been read; the caller then passes the file to
+// PlaceFile or ExtractArchive and finally to DiscardStaged. A file larger
+// than the configured maximum is rejected as soon as the limit is exceeded.
+func (s *UploadService) StageFile(src io.Reader) (*os.File, int64, error) {
+	file, err := os.CreateTemp(s.cfg.StagingDir, "upload-part-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.cfg.MaxSize > 0 {
+		// 多读一个字节以判断是否超出限制
+		src = io.LimitReader(src, s.cfg.MaxSize+1)
+	}
+	n, err := io.Copy(file, src)
+	if err == nil && s.cfg.MaxSize > 0 && n > s.cfg.MaxSize {
+		err = newError(CodeTooLarge, "file exceeds the limit of %d bytes", s.cfg.MaxSize)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		s.DiscardStaged(file)
+		return nil, 0, err
+	}
+	return file, n, nil
+}
+
+// PlaceFile moves a file returned by StageFile to name below dir. dir may be
+// relative to the workspace root and defaults to the upload directory; name
+// may contain slashes, whose directories are created. It returns the
+// destination and the size of the file.
+func (s *UploadService) PlaceFile(file *os.File, name, dir string) (string, int64, error) {
+	if name == "" || !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", 0, newError(CodeInvalidRequest, "invalid file name: %q", name)
+	}
+
+	// 目标文件本身也可能是指向工作区外的符号链接，因此检查完整路径
+	dst, err := s.fileService.policy.resolve(filepath.Join(s.fileService.uploadDir(dir), filepath.FromSlash(name)))
+	if err != nil {
+		return "", 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	if err := moveIntoPlace(s.fileService.policy, file, dst); err != nil {
+		return "", 0, classifyFSError(err)
+	}
+	return dst, info.Size(), nil
+}
+
+// ExtractArchive extracts a file returned by StageFile into dir like
+// FileService.ExtractArchive, within the configured extraction limits
+func (s *UploadService) ExtractArchive(file *os.File, size int64, name, dir, format string) (*model.ExtractResponse, error) {
+	return s.fileService.ExtractArchive(file, size, name, dir, format, ExtractLimits{
+		StagingDir: s.cfg.StagingDir,
+		MaxBytes:   s.cfg.ExtractMaxBytes,
+		MaxEntries: s.cfg.ExtractMaxEntries,
+	})
+}
+
+// DiscardStaged closes a file returned by StageFile and removes it unless
+// it has been moved into place
+func (s *UploadService) DiscardStaged(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// GetUpload returns the state of an upload, including the received ranges
+func (s *UploadService) GetUpload(id string) (*model.UploadInfo, error) {
+	u, err := s.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.info(u), nil
+}
+
+// WriteChunk writes data to an upload at offset. With sequential set the
+// offset must equal the number of contiguous bytes received so far, as the
+// tus protocol requires. Bytes read before an error are kept, so that an
+// interrupted request can be resumed. The upload completes as soon as every
+// byte has been received.
+func (s *UploadService) WriteChunk(id string, offset int64, sequential bool, data io.Reader) (*model.UploadInfo, error) {
+	u, err := s.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	u.mu.Lock()
+	switch {
+	case u.status != UploadStatusUploading:
+		u.mu.Unlock()
+		// 已完成的上传允许重复提交最后一次请求
+		if offset == u.size {
+			return s.info(u), nil
+		}
+		return nil, newError(CodeInvalidRequest, "upload %s is already complete", id)
+	case u.completing:
+		u.mu.Unlock()
+		return nil, newError(CodeConflict, "upload %s is being completed", id)
+	case sequential && offset != u.offsetLocked():
+		current := u.offsetLocked()
+		u.mu.Unlock()
+		return nil, newError(CodeOffsetMismatch, "offset %d does not match the current offset %d", offset, current)
+	case offset < 0 || offset > u.size:
+		u.mu.Unlock()
+		return nil, newError(CodeInvalidRequest, "offset %d is outside the upload of %d bytes", offset, u.size)
+	}
+	// 上传可能同时被 DeleteUpload 丢弃，文件句柄须在锁内取得
+	file := u.file
+	if file == nil {
+		u.mu.Unlock()
+		return nil, newError(CodeNotFound, "upload not found: %s", id)
+	}
+	u.writers++
+	u.lastActive = time.Now()
+	u.mu.Unlock()
+
+	// 不同区间的写入可以并发进行，区间列表在写入后再更新
+	n, err := io.Copy(io.NewOffsetWriter(file, offset), io.LimitReader(data, u.size-offset))
+	if err == nil {
+		var extra [1]byte
+		if m, _ := data.Read(extra[:]); m > 0 {
+			err = newError(CodeInvalidRequest, "chunk at offset %d exceeds the upload size of %d bytes", offset, u.size)
+		}
+	}
+
+	u.mu.Lock()
+	u.writers--
+	u.lastActive = time.Now()
+	if n > 0 {
+		u.addRangeLocked(model.ByteRange{Start: offset, End: offset + n})
+	}
+	// 在同一把锁内认领完成操作，之后到达的写入会被拒绝
+	ready := u.writers == 0 && !u.completing && u.status == UploadStatusUploading && u.receivedLocked() == u.size
+	if ready {
+		u.completing = true
+	}
+	u.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	if ready {
+		if err := s.complete(u); err != nil {
+			return nil, err
+		}
+	}
+	return s.info(u), nil
+}
+
+// DeleteUpload aborts an upload and discards the received data
+func (s *UploadService) DeleteUpload(id string) error {
+	u, err := s.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.uploads, id)
+	s.mu.Unlock()
+	u.discard()
+	return nil
+}
+
+func (s *UploadService) lookup(id string) (*upload, error) {
+	s.mu.RLock()
+	u, ok := s.uploads[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, newError(CodeNotFound, "upload not found: %s", id)
+	}
+	return u, nil
+}
+
+// complete verifies the checksum of a fully received upload and moves the
+// staging file to its destination. An upload whose checksum does not match
+// is discarded, since there is no telling which part is corrupt. The caller
+// must have set completing while it found the upload complete, which keeps
+// other requests from writing to the staging file meanwhile.
+func (s *UploadService) complete(u *upload) error {
+	u.mu.Lock()
+	file := u.file
+	if file == nil {
+		u.completing = false
+		u.mu.Unlock()
+		return newError(CodeNotFound, "upload not found: %s", u.id)
+	}
+	u.mu.Unlock()
+
+	dst, err := u.finish(s.fileService.policy, file)
+	if err != nil {
+		var serviceErr *Error
+		if errors.As(err, &serviceErr) && serviceErr.Code == CodeChecksumMismatch {
+			s.mu.Lock()
+			delete(s.uploads, u.id)
+			s.mu.Unlock()
+			u.discard()
+			return err
+		}
+
+		// 其他错误（如目标目录不可写）可以在排除后重试
+		u.mu.Lock()
+		u.completing = false
+		u.mu.Unlock()
+		return classifyFSError(err)
+	}
+
+	u.mu.Lock()
+	u.status = UploadStatusCompleted
+	u.completing = false
+	u.file = nil
+	u.path = dst
+	u.completedAt = time.Now()
+	u.lastActive = u.completedAt
+	u.mu.Unlock()
+	return nil
+}
+
+// finish syncs and checks the staging file, renames it into place and
+// returns the final path
+func (u *upload) finish(policy *PathPolicy, file *os.File) (string, error) {
+	if err := file.Sync(); err != nil {
+		return "", err
+	}
+
+	if u.sha256 != "" {
+		hash := sha256.New()
+		if _, err := io.Copy(hash, io.NewSectionReader(file, 0, u.size)); err != nil {
+			return "", err
+		}
+		if sum := hex.EncodeToString(hash.Sum(nil)); sum != u.sha256 {
+			return "", newError(CodeChecksumMismatch, "sha256 mismatch: expected %s, got %s; the upload was discarded", u.sha256, sum)
+		}
+	}
+
+	// 创建会话后目标路径可能被替换为符号链接，因此重新检查
+	dst, err := policy.resolve(filepath.Join(u.dir, filepath.FromSlash(u.filename)))
+	if err != nil {
+		return "", err
+	}
+	if err := moveIntoPlace(policy, file, dst); err != nil {
+		return "", err
+	}
+
+	file.Close()
+	return dst, nil
+}
+
+// moveIntoPlace renames the staging file to the resolved path dst, creating
+// missing parent directories
+func moveIntoPlace(policy *PathPolicy, file *os.File, dst string) error {
+	if err := policy.mkdirAll(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+
+	return policy.at(dst, func(at string) error {
+		err := os.Rename(file.Name(), at)
+		if errors.Is(err, syscall.EXDEV) {
+			// 暂存目录在另一个文件系统上时，先复制到目标目录再 rename
+			err = copyIntoPlace(file, at)
+			if err == nil {
+				os.Remove(file.Name())
+			}
+		}
+		return err
+	})
+}
+
+// copyIntoPlace copies src to a temporary file next to dst and renames it,
+// so that dst never holds partial content
+func copyIntoPlace(src *os.File, dst string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, io.NewSectionReader(src, 0, 1<<62))
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// discard closes and removes the staging file of an unfinished upload
+func (u *upload) discard() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.file != nil {
+		u.file.Close()
+		u.file = nil
+		os.Remove(u.staging)
+	}
+}
+
+// offsetLocked returns the number of contiguous bytes received from the
+// start of the file
+func (u *upload) offsetLocked() int64 {
+	if len(u.ranges) > 0 && u.ranges[0].Start == 0 {
+		return u.ranges[0].End
+	}
+	return 0
+}
+
+func (u *upload) receivedLocked() int64 {
+	var total int64
+	for _, r := range u.ranges {
+		total += r.End - r.Start
+	}
+	return total
+}
+
+// addRangeLocked adds a received range, merging it with overlapping and
+// adjacent ranges
+func (u *upload) addRangeLocked(r model.ByteRange) {
+	ranges := append(u.ranges, r)
+	sort.Slice(ranges, func(a, b int) bool {
+		return ranges[a].Start < ranges[b].Start
+	})
+
+	merged := ranges[:1]
+	for _, next := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if next.Start <= last.End {
+			last.End = max(last.End, next.End)
+		} else {
+			merged = append(merged, next)
+		}
+	}
+	u.ranges = merged
+}
+
+func (s *UploadService) info(u *upload) *model.UploadInfo {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	info := &model.UploadInfo{
+		ID:        u.id,
+		Filename:  u.filename,
+		Path:      u.path,
+		Size:      u.size,
+		Offset:    u.offsetLocked(),
+		Received:  u.receivedLocked(),
+		Ranges:    append([]model.ByteRange{}, u.ranges...),
+		SHA256:    u.sha256,
+		Status:    u.status,
+		CreatedAt: u.createdAt,
+		ExpiresAt: u.lastActive.Add(s.cfg.SessionTTL),
+	}
+	if u.status == UploadStatusCompleted && !u.completedAt.IsZero() {
+		completedAt := u.completedAt
+		info.CompletedAt = &completedAt
+		// 空文件没有收到任何区间
+		info.Offset, info.Received = u.size, u.size
+	}
+	return info
+}
+
+// reapLoop periodically discards uploads that have not received data within
+// the session TTL, and forgets completed uploads after the same time
+func (s *UploadService) reapLoop() {
+	interval := s.cfg.SessionTTL / 2
+	if interval <= 0 || interval > time.Minute {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.reap(time.Now())
+	}
+}
+
+func (s *UploadService) reap(now time.Time) {
+	s.mu.Lock()
+	var expired []*upload
+	for id, u := range s.uploads {
+		u.mu.Lock()
+		idle := u.writers == 0 && !u.completing && now.Sub(u.lastActive) > s.cfg.SessionTTL
+		abandoned := idle && u.status == UploadStatusUploading
+		u.mu.Unlock()
+
+		if idle {
+			delete(s.uploads, id)
+			expired = append(expired, u)
+		}
+		if abandoned {
+			log.Printf("Discarding abandoned upload %s (%s)", u.id, u.filename)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, u := range expired {
+		u.discard()
+	}
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"litterbox-agent/internal/config"
+	"litterbox-agent/internal/model"
+)
+
+func newTestUploadService(t *testing.T) (*UploadService, string) {
+	t.Helper()
+
+	fileService, dir := newTestFileService(t)
+	s, err := NewUploadService(fileService, config.UploadConfig{
+		StagingDir: filepath.Join(dir, ".staging"),
+		SessionTTL: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func TestCreateUploadRejectsNonLocalFilename(t *testing.T) {
+	s, dir := newTestUploadService(t)
+
+	for _, name := range []string{"../x", "../../x", "sub/../../x", "/etc/x"} {
+		_, err := s.CreateUpload(&model.UploadRequest{Filename: name, Path: filepath.Join(dir, "uploads"), Size: 1})
+		var serviceErr *Error
+		if !errors.As(err, &serviceErr) || serviceErr.Code != CodeInvalidRequest {
+			t.Errorf("CreateUpload(%q) error = %v, want %s", name, err, CodeInvalidRequest)
+		}
+	}
+
+	info, err := s.CreateUpload(&model.UploadRequest{Filename: "sub/ok.txt", Path: filepath.Join(dir, "uploads"), Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "uploads", "sub", "ok.txt"); info.Path != want {
+		t.Errorf("path = %q, want %q", info.Path, want)
+	}
+}
+
+func TestWriteChunkConcurrentWithDelete(t *testing.T) {
+	s, dir := newTestUploadService(t)
+
+	for i := 0; i < 20; i++ {
+		info, err := s.CreateUpload(&model.UploadRequest{Filename: "file.bin", Path: dir, Size: 1 << 16})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for chunk := 0; chunk < 4; chunk++ {
+			wg.Add(1)
+			go func(offset int64) {
+				defer wg.Done()
+				// 与 DeleteUpload 竞争时可能失败，但不能出现数据竞争
+				s.WriteChunk(info.ID, offset, false, bytes.NewReader(make([]byte, 1<<14)))
+			}(int64(chunk) << 14)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.DeleteUpload(info.ID)
+		}()
+		wg.Wait()
+	}
+}
+
+func TestWriteChunkRejectedWhileCompleting(t *testing.T) {
+	s, dir := newTestUploadService(t)
+
+	info, err := s.CreateUpload(&model.UploadRequest{Filename: "file.bin", Path: dir, Size: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.lookup(info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟收齐数据的请求已认领完成操作、但尚未移动暂存文件的时刻
+	if _, err := s.WriteChunk(info.ID, 0, false, bytes.NewReader([]byte("abc"))); err != nil {
+		t.Fatal(err)
+	}
+	u.mu.Lock()
+	u.completing = true
+	u.mu.Unlock()
+
+	_, err = s.WriteChunk(info.ID, 0, false, bytes.NewReader([]byte("xyzw")))
+	var serviceErr *Error
+	if !errors.As(err, &serviceErr) || serviceErr.Code != CodeConflict {
+		t.Errorf("write while completing: error = %v, want %s", err, CodeConflict)
+	}
+	if u.writers != 0 {
+		t.Errorf("writers = %d, want the rejected write not to be counted", u.writers)
+	}
+}
+
+func TestOverlappingFinalChunks(t *testing.T) {
+	s, dir := newTestUploadService(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<12)
+
+	for i := 0; i < 20; i++ {
+		info, err := s.CreateUpload(&model.UploadRequest{Filename: "file.bin", Path: dir, Size: int64(len(data))})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// 同一数据的重复 PUT 可能在完成期间到达而被拒绝，但不能改动正在移动的文件
+				s.WriteChunk(info.ID, 0, false, bytes.NewReader(data))
+			}()
+		}
+		wg.Wait()
+
+		got, err := s.GetUpload(info.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != UploadStatusCompleted {
+			t.Fatalf("status = %s, want %s", got.Status, UploadStatusCompleted)
+		}
+		written, err := os.ReadFile(got.Path)
+		if err != nil || !bytes.Equal(written, data) {
+			t.Fatalf("completed file differs from the uploaded data: %v", err)
+		}
+	}
+}
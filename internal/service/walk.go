@@ -0,0 +1,236 @@
+package service
+
+import (
+	"bufio"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// walkOptions controls which entries walk visits
+type walkOptions struct {
+	maxDepth         int  // 最大深度，1 表示只遍历直接子项，0 表示不限制
+	showHidden       bool // 是否包含以 . 开头的文件和目录
+	respectGitignore bool // 是否跳过 .gitignore 忽略的文件
+}
+
+// walkFunc is called for every entry visited by walk, with the entry's Lstat
+// information and its depth below the root (starting at 1). Returning
+// filepath.SkipDir for a directory skips its contents; returning fs.SkipAll
+// stops the walk.
+type walkFunc func(path string, info os.FileInfo, depth int) error
+
+// walk visits the entries below the canonical directory root in lexical
+// order, directories before their contents. Every directory is opened
+// through openDir, so symlinks are reported but never followed, not even one
+// swapped into the tree during the walk. Directories below root that cannot
+// be read are skipped silently.
+func (p *PathPolicy) walk(root string, opts walkOptions, fn walkFunc) error {
+	var ignore *ignoreMatcher
+	if opts.respectGitignore {
+		ignore = newIgnoreMatcher(root)
+	}
+
+	err := p.walkDir(root, 1, opts, ignore, fn)
+	if err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func (p *PathPolicy) walkDir(dir string, depth int, opts walkOptions, ignore *ignoreMatcher, fn walkFunc) error {
+	infos, err := p.readDir(dir)
+	if err != nil {
+		if depth > 1 {
+			return nil
+		}
+		return err
+	}
+	if ignore != nil && depth > 1 {
+		ignore = ignore.withDir(dir)
+	}
+
+	for _, info := range infos {
+		name := info.Name()
+		if !opts.showHidden && strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		if ignore != nil && (name == ".git" || ignore.ignored(path, info.IsDir())) {
+			continue
+		}
+
+		if err := fn(path, info, depth); err != nil {
+			if err == filepath.SkipDir {
+				continue
+			}
+			return err
+		}
+
+		if info.IsDir() && (opts.maxDepth <= 0 || depth < opts.maxDepth) {
+			if err := p.walkDir(path, depth+1, opts, ignore, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readDir returns the Lstat information of the entries of the canonical
+// directory dir sorted by name. The directory is opened through openDir and
+// its entries are looked up relative to it rather than by path.
+func (p *PathPolicy) readDir(dir string) ([]os.FileInfo, error) {
+	pinned, err := p.openDir(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer pinned.Close()
+
+	file, err := openAt(pinned, ".", os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	names, err := file.Readdirnames(-1)
+	sort.Strings(names)
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		info, lstatErr := os.Lstat(pathAt(pinned, name))
+		if lstatErr != nil {
+			// 读取目录后被删除
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, err
+}
+
+// ignoreRule is a single pattern from a .gitignore file
+type ignoreRule struct {
+	dir      string // .gitignore 所在目录
+	pattern  string
+	negate   bool // 以 ! 开头，重新包含被忽略的文件
+	dirOnly  bool // 以 / 结尾，只匹配目录
+	anchored bool // 包含 /，相对于 .gitignore 所在目录匹配
+}
+
+// ignoreMatcher evaluates the .gitignore rules that apply to a directory,
+// those of parent directories first so that deeper rules take precedence
+type ignoreMatcher struct {
+	rules []ignoreRule
+}
+
+// newIgnoreMatcher loads the .gitignore files that apply to root: those of
+// the enclosing git repository from its top level down, or only root's own
+// file when root is not inside a repository
+func newIgnoreMatcher(root string) *ignoreMatcher {
+	dirs := []string{root}
+	for dir := root; !isRepoRoot(dir); {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			dirs = []string{root}
+			break
+		}
+		dir = parent
+		dirs = append(dirs, dir)
+	}
+
+	m := &ignoreMatcher{}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		m = m.withDir(dirs[i])
+	}
+	return m
+}
+
+func isRepoRoot(dir string) bool {
+	_, err := os.Lstat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// withDir returns a matcher that also applies the .gitignore file in dir, if
+// there is one. The receiver is not modified.
+func (m *ignoreMatcher) withDir(dir string) *ignoreMatcher {
+	rules := parseGitignore(dir)
+	if len(rules) == 0 {
+		return m
+	}
+
+	merged := make([]ignoreRule, 0, len(m.rules)+len(rules))
+	merged = append(merged, m.rules...)
+	merged = append(merged, rules...)
+	return &ignoreMatcher{rules: merged}
+}
+
+// ignored reports whether path is excluded; the last matching rule wins
+func (m *ignoreMatcher) ignored(path string, isDir bool) bool {
+	ignored := false
+	base := filepath.Base(path)
+
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		var matched bool
+		if rule.anchored {
+			rel, err := filepath.Rel(rule.dir, path)
+			if err != nil {
+				continue
+			}
+			matched = globMatch(rule.pattern, filepath.ToSlash(rel))
+		} else {
+			matched = globMatch(rule.pattern, base)
+		}
+
+		if matched {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// parseGitignore reads the rules of dir/.gitignore
+func parseGitignore(dir string) []ignoreRule {
+	file, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{dir: dir}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	return rules
+}
@@ -16,6 +16,10 @@ func WriteError(w http.ResponseWriter, status int, message string) {
 	WriteJSON(w, status, model.ErrorResponse{Error: message})
 }
 
+func WriteErrorCode(w http.ResponseWriter, status int, code, message string) {
+	WriteJSON(w, status, model.ErrorResponse{Error: message, Code: code})
+}
+
 func WriteSuccess(w http.ResponseWriter, data interface{}) {
 	WriteJSON(w, http.StatusOK, data)
 }